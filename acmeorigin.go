@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// acmeTLSALPNOrigin is a tiny self-signed HTTPS origin started on demand for
+// the "acme-tls-alpn" -test-targets entry. It gives proxies behind a
+// corporate PAC something to reach that validates TLS + ALPN end-to-end
+// without depending on real ACME/Let's Encrypt infrastructure — a genuine
+// tls-alpn-01 challenge needs a publicly routable, DNS-resolvable origin,
+// which a per-run CLI check can't provide.
+var acmeTLSALPNOrigin struct {
+	once sync.Once
+	addr string
+	err  error
+}
+
+// startACMETLSALPNOrigin lazily starts the origin (once per process) and
+// returns its host:port.
+func startACMETLSALPNOrigin() (string, error) {
+	acmeTLSALPNOrigin.once.Do(func() {
+		cert, err := selfSignedCert()
+		if err != nil {
+			acmeTLSALPNOrigin.err = fmt.Errorf("generate self-signed cert: %w", err)
+			return
+		}
+
+		ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		})
+		if err != nil {
+			acmeTLSALPNOrigin.err = fmt.Errorf("listen: %w", err)
+			return
+		}
+
+		srv := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("acme-tls-alpn-ok"))
+			}),
+		}
+		acmeTLSALPNOrigin.addr = ln.Addr().String()
+		go srv.Serve(ln)
+	})
+	return acmeTLSALPNOrigin.addr, acmeTLSALPNOrigin.err
+}
+
+// selfSignedCert generates a throwaway ECDSA P-256 certificate for the
+// local acme-tls-alpn origin; no real cert/key material ever touches disk.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "proxy-checker acme-tls-alpn self-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
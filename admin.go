@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// adminTopN is how many rows TopSlowest/TopFailing return in the -admin-addr
+// snapshot.
+const adminTopN = 10
+
+// adminSnapshot is the JSON document served at /stats while a scan backed
+// by -state is running: the same counters printed to stderr at the end of
+// a run, available live instead of only in the final summary.
+type adminSnapshot struct {
+	FailReasons map[string]uint64 `json:"fail_reasons"`
+	SkipReasons map[string]uint64 `json:"skip_reasons"`
+	StateRows   int               `json:"state_rows"`
+	TopSlowest  []ProxyState      `json:"top_slowest"`
+	TopFailing  []ProxyState      `json:"top_failing"`
+}
+
+// startAdminServer serves adminSnapshot as JSON on addr until ctx is
+// canceled. store may be nil (no -state given), in which case the
+// state-derived fields are left empty.
+func startAdminServer(ctx context.Context, addr string, store *StateStore, failReasons, skipReasons *CounterMap) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		snap := adminSnapshot{
+			FailReasons: failReasons.Snapshot(),
+			SkipReasons: skipReasons.Snapshot(),
+		}
+		if store != nil {
+			snap.StateRows = store.Len()
+			snap.TopSlowest = store.TopSlowest(adminTopN)
+			snap.TopFailing = store.TopFailing(adminTopN)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(snap)
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin 接口退出: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	return srv
+}
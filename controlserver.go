@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// workerExitSentinel is a magic Job.RawLine value pushed through the shared
+// jobs channel to tell exactly one worker to exit without closing jobs (which
+// would stop the whole pool). No real input line can produce it.
+const workerExitSentinel = "\x00__worker_exit__"
+
+// ControlDeps is everything a -control-addr connection handler needs to read
+// or mutate. All counters are the same atomics the progress goroutine already
+// reads, so STATS adds no new locking on the hot path.
+type ControlDeps struct {
+	Total uint64
+
+	Done, OkIP, OkLine, Fail, Skip, ReqCnt, ActiveW *uint64
+	DynLim                                          *int64
+	LiveWorkers                                     *int64
+
+	// EMAIPSBits/EMAQPSBits are math.Float64bits snapshots the progress
+	// ticker stores every tick, so STATS can read the same smoothed
+	// rates it prints to stderr without a second EMA or a mutex.
+	EMAIPSBits, EMAQPSBits *uint64
+
+	FailReasons, SkipReasons *CounterMap
+
+	// OutWriter may be nil (e.g. -redis-role=worker never opens one).
+	OutWriter OutputWriter
+
+	SpawnWorker   func()
+	ShrinkWorkers func(n int)
+
+	// RequestQuit triggers the normal end-of-input drain path (stop
+	// scanning -ip, close jobs, wg.Wait, close outcomes) exactly once.
+	RequestQuit func()
+}
+
+// startControlServer listens on addr and serves the line-based control
+// protocol described in -control-addr's help text until ctx is canceled.
+// addr == "" disables it entirely; the caller shouldn't call this then.
+func startControlServer(ctx context.Context, addr string, deps *ControlDeps) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen -control-addr %s: %w", addr, err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleControlConn(conn, deps)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+	return ln, nil
+}
+
+func handleControlConn(conn net.Conn, deps *ControlDeps) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		cmd := strings.ToUpper(fields[0])
+		switch cmd {
+		case "STATS":
+			fmt.Fprint(conn, controlStatsLine(deps))
+		case "RATE":
+			handleControlRate(conn, deps, fields)
+		case "WORKERS":
+			handleControlWorkers(conn, deps, fields)
+		case "REASONS":
+			fmt.Fprintf(conn, "fail %v\nskip %v\n", deps.FailReasons.Snapshot(), deps.SkipReasons.Snapshot())
+		case "FLUSH":
+			if deps.OutWriter == nil {
+				fmt.Fprintln(conn, "ERR no output writer (redis worker role)")
+				continue
+			}
+			if err := deps.OutWriter.Flush(); err != nil {
+				fmt.Fprintf(conn, "ERR %v\n", err)
+				continue
+			}
+			fmt.Fprintln(conn, "OK")
+		case "QUIT":
+			deps.RequestQuit()
+			fmt.Fprintln(conn, "OK draining")
+		default:
+			fmt.Fprintf(conn, "ERR unknown command %q (want STATS/RATE/WORKERS/REASONS/FLUSH/QUIT)\n", fields[0])
+		}
+	}
+}
+
+func controlStatsLine(deps *ControlDeps) string {
+	d := atomic.LoadUint64(deps.Done)
+	emaIPS := math.Float64frombits(atomic.LoadUint64(deps.EMAIPSBits))
+	emaQPS := math.Float64frombits(atomic.LoadUint64(deps.EMAQPSBits))
+
+	left := int64(deps.Total) - int64(d)
+	if left < 0 {
+		left = 0
+	}
+	var eta float64
+	if emaIPS > 0 {
+		eta = float64(left) / emaIPS
+	}
+
+	return fmt.Sprintf(
+		"done=%d total=%d left=%d ok_ip=%d ok_line=%d fail=%d skip=%d req=%d active=%d dyn=%d workers=%d ips=%.1f qps=%.1f eta=%s\n",
+		d, deps.Total, left,
+		atomic.LoadUint64(deps.OkIP), atomic.LoadUint64(deps.OkLine),
+		atomic.LoadUint64(deps.Fail), atomic.LoadUint64(deps.Skip), atomic.LoadUint64(deps.ReqCnt),
+		atomic.LoadUint64(deps.ActiveW), atomic.LoadInt64(deps.DynLim), atomic.LoadInt64(deps.LiveWorkers),
+		emaIPS, emaQPS, formatETA(time.Duration(eta*float64(time.Second))),
+	)
+}
+
+func handleControlRate(conn net.Conn, deps *ControlDeps, fields []string) {
+	if len(fields) != 2 {
+		fmt.Fprintln(conn, "ERR usage: RATE <n>")
+		return
+	}
+	n, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || n < 0 {
+		fmt.Fprintln(conn, "ERR RATE <n> needs a non-negative integer")
+		return
+	}
+	atomic.StoreInt64(deps.DynLim, n)
+	fmt.Fprintln(conn, "OK")
+}
+
+func handleControlWorkers(conn net.Conn, deps *ControlDeps, fields []string) {
+	if len(fields) != 2 {
+		fmt.Fprintln(conn, "ERR usage: WORKERS <n>")
+		return
+	}
+	target, err := strconv.Atoi(fields[1])
+	if err != nil || target < 0 {
+		fmt.Fprintln(conn, "ERR WORKERS <n> needs a non-negative integer")
+		return
+	}
+	cur := int(atomic.LoadInt64(deps.LiveWorkers))
+	switch {
+	case target > cur:
+		for i := 0; i < target-cur; i++ {
+			deps.SpawnWorker()
+		}
+	case target < cur:
+		deps.ShrinkWorkers(cur - target)
+	}
+	fmt.Fprintf(conn, "OK workers=%d->%d\n", cur, target)
+}
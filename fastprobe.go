@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/proxy"
+)
+
+// probeEngineFastHTTP is the -probe-engine value that swaps the net/http
+// transport built by testHTTPProxy/testHTTPSProxy/testSocks5Proxy for the
+// fasthttp-based IP-info fetch in this file. Anything else (including "")
+// keeps the existing http.Transport/http.Client path.
+const probeEngineFastHTTP = "fasthttp"
+
+// fastIPInfoClient builds a one-shot fasthttp.Client around dial. Unlike
+// the http.Transport used by the default engine, fasthttp.Client pulls its
+// Request/Response objects from its own internal sync.Pool (see
+// fasthttp.AcquireRequest/AcquireResponse below), so repeating this per
+// proxy attempt doesn't repeat the http.Transport's allocation cost.
+func fastIPInfoClient(dial fasthttp.DialFunc, timeout time.Duration) *fasthttp.Client {
+	return &fasthttp.Client{
+		Dial:                     dial,
+		MaxConnsPerHost:          1,
+		MaxIdleConnDuration:      -1, // 不保留空闲连接，等价于 DisableKeepAlives
+		ReadTimeout:              timeout,
+		WriteTimeout:             timeout,
+		MaxResponseBodySize:      64 * 1024,
+		NoDefaultUserAgentHeader: true,
+		TLSConfig:                &tls.Config{InsecureSkipVerify: true},
+	}
+}
+
+// fetchIPInfoFast mirrors IPInfoChain.Fetch, but routes httpJSONProvider
+// lookups through fasthttp instead of net/http. Non-HTTP providers (mmdb)
+// never touch the client, so they fall through to their normal Lookup
+// unchanged.
+func fetchIPInfoFast(ctx context.Context, chain IPInfoChain, dial fasthttp.DialFunc, timeout time.Duration, proxyHost string, reqCounter *uint64) (IPInfo, error) {
+	client := fastIPInfoClient(dial, timeout)
+
+	var lastErr error
+	for _, p := range chain.providers {
+		hp, ok := p.(*httpJSONProvider)
+		if !ok {
+			info, err := p.Lookup(ctx, nil, proxyHost)
+			if err == nil {
+				return info, nil
+			}
+			lastErr = fmt.Errorf("%s: %w", p.Name(), err)
+			continue
+		}
+
+		info, err := fastFetchOne(client, hp, timeout, reqCounter)
+		if err == nil {
+			return info, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", hp.Name(), err)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no ipinfo providers configured")
+	}
+	return IPInfo{}, lastErr
+}
+
+func fastFetchOne(client *fasthttp.Client, p *httpJSONProvider, timeout time.Duration, reqCounter *uint64) (IPInfo, error) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	// 绝对形式的请求行（带 scheme+host）对隧道直连目标和仍需转发的 HTTP
+	// 代理都有效（RFC 7230 §5.3.2 要求源服务器接受绝对形式），因此这里
+	// 不需要再按代理类型区分请求行形式。
+	req.SetRequestURI(p.url)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	if reqCounter != nil {
+		atomic.AddUint64(reqCounter, 1)
+	}
+
+	if err := client.DoTimeout(req, resp, timeout); err != nil {
+		return IPInfo{}, fmt.Errorf("%s request failed: %v", p.Name(), err)
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return IPInfo{StatusCode: resp.StatusCode(), Provider: p.name}, fmt.Errorf("%s status=%d", p.name, resp.StatusCode())
+	}
+
+	info, err := p.parse(resp.Body())
+	info.StatusCode = resp.StatusCode()
+	info.Provider = p.name
+	return info, err
+}
+
+// fastDialPlainHTTP always connects to the proxy itself (ctx/addr supplied
+// by fasthttp is the target, not the proxy) — matching how testHTTPProxy's
+// http.Transport dials when Proxy is set.
+func fastDialPlainHTTP(ctx context.Context, proxyAddr string, upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error), ipPref ipVersionPref, timeout time.Duration, resolver *HostResolver) fasthttp.DialFunc {
+	baseDialer := newDialer(timeout / 2)
+	return func(_ string) (net.Conn, error) {
+		if upstreamDial != nil {
+			return upstreamDial(ctx, "tcp", proxyAddr)
+		}
+		return dialWithIPPreference(ctx, baseDialer, "tcp", proxyAddr, ipPref, resolver)
+	}
+}
+
+// fastDialHTTPSProxy CONNECT-tunnels through hpd to the per-provider target
+// host fasthttp passes in addr, mirroring testHTTPSProxy's hpd.DialContext.
+func fastDialHTTPSProxy(ctx context.Context, hpd *HTTPProxyDialer) fasthttp.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		return hpd.DialContext(ctx, "tcp", addr)
+	}
+}
+
+// fastDialSocks5 tunnels through a SOCKS5 dialer to the per-provider target
+// host, mirroring testSocks5Proxy's dialer.Dial.
+func fastDialSocks5(dialer proxy.Dialer) fasthttp.DialFunc {
+	return func(addr string) (net.Conn, error) {
+		return dialer.Dial("tcp", addr)
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// detectFDLimit returns the effective file-descriptor ceiling for this
+// process: the minimum of RLIMIT_NOFILE, the kernel-wide fs.nr_open and
+// fs.file-max caps, and (when running in a container) the cgroup's
+// effective ceiling. Any source that can't be read is simply skipped.
+func detectFDLimit() uint64 {
+	var lim uint64
+	var rlim unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim); err == nil && rlim.Cur > 0 {
+		lim = uint64(rlim.Cur)
+	} else {
+		lim = 8192
+	}
+
+	if v := readProcFileUint("/proc/sys/fs/nr_open"); v > 0 && v < lim {
+		lim = v
+	}
+	if v := readProcFileUint("/proc/sys/fs/file-max"); v > 0 && v < lim {
+		lim = v
+	}
+	if v := readCgroupFDCeiling(); v > 0 && v < lim {
+		lim = v
+	}
+
+	return lim
+}
+
+func readProcFileUint(path string) uint64 {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// readCgroupFDCeiling returns a conservative FD ceiling implied by the
+// current cgroup's pids.max, when present — containers that cap the number
+// of tasks/threads indirectly cap how many descriptors this process can
+// realistically open before hitting other resource walls.
+func readCgroupFDCeiling() uint64 {
+	b, err := os.ReadFile("/sys/fs/cgroup/pids.max")
+	if err != nil {
+		return 0
+	}
+	txt := strings.TrimSpace(string(b))
+	if txt == "" || txt == "max" {
+		return 0
+	}
+	v, err := strconv.ParseUint(txt, 10, 64)
+	if err != nil || v == 0 {
+		return 0
+	}
+	return v
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// hashRing is a consistent-hash ring with virtual nodes: joining/leaving a
+// node only remaps the keys that land in its arc, instead of reshuffling
+// everything like a plain hash % N.Len() would. Used by -redis-addr worker
+// mode to decide which worker owns a given proxy's shard key, so two
+// workers never hammer the same upstream /24 at once.
+type hashRing struct {
+	mu      sync.RWMutex
+	vnodes  int
+	points  []uint32          // sorted virtual-node hashes
+	owners  map[uint32]string // virtual-node hash -> real node id
+	members map[string]bool
+}
+
+func newHashRing(vnodes int) *hashRing {
+	if vnodes <= 0 {
+		vnodes = 1
+	}
+	return &hashRing{
+		vnodes:  vnodes,
+		owners:  make(map[uint32]string),
+		members: make(map[string]bool),
+	}
+}
+
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// AddNode is a no-op if id is already a member (re-registering a live node
+// on every heartbeat refresh shouldn't reshuffle the ring).
+func (r *hashRing) AddNode(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.members[id] {
+		return
+	}
+	r.members[id] = true
+	for i := 0; i < r.vnodes; i++ {
+		h := ringHash(id + "#" + strconv.Itoa(i))
+		r.owners[h] = id
+		r.points = append(r.points, h)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *hashRing) RemoveNode(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.members[id] {
+		return
+	}
+	delete(r.members, id)
+	kept := r.points[:0]
+	for _, h := range r.points {
+		if r.owners[h] == id {
+			delete(r.owners, h)
+			continue
+		}
+		kept = append(kept, h)
+	}
+	r.points = kept
+}
+
+// Owner returns the node id responsible for key, and false if the ring has
+// no members yet.
+func (r *hashRing) Owner(key string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return "", false
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0 // wrap around the ring
+	}
+	return r.owners[r.points[i]], true
+}
+
+// Sync replaces ring membership with exactly nodeIDs, adding newcomers and
+// evicting anyone no longer present — the shape a periodic refresh against
+// the Redis node registry needs.
+func (r *hashRing) Sync(nodeIDs []string) {
+	want := make(map[string]bool, len(nodeIDs))
+	for _, id := range nodeIDs {
+		want[id] = true
+		r.AddNode(id)
+	}
+	r.mu.RLock()
+	var stale []string
+	for id := range r.members {
+		if !want[id] {
+			stale = append(stale, id)
+		}
+	}
+	r.mu.RUnlock()
+	for _, id := range stale {
+		r.RemoveNode(id)
+	}
+}
+
+func (r *hashRing) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, 0, len(r.members))
+	for id := range r.members {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// shardKey picks the ring key for a job: the /24 for an IPv4 host (so the
+// whole subnet a datacenter hands out proxies from lands on one worker),
+// the /64 for IPv6, or the bare hostname otherwise.
+func shardKey(proxyAddr string) string {
+	host := hostFromHostPort(proxyAddr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
@@ -5,23 +5,28 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
 )
 
 // ============================================================
@@ -153,12 +158,130 @@ func (d *HTTPProxyDialerImproved) DialContext(ctx context.Context, network, addr
 	return conn, nil
 }
 
+// improvedIPInfoChain is the *Improved test functions' own entry point into
+// the IPInfoProvider chain (ipinfo_providers.go). main.go's test path builds
+// its IPInfoChain from -ipinfo/-mmdb-path and threads it through as a
+// parameter; this file's functions don't take that plumbing, so they fall
+// back to the same single "furry" provider that was the hardcoded default
+// before the chain existed.
+var improvedIPInfoChain = IPInfoChain{
+	providers: []IPInfoProvider{&httpJSONProvider{name: "furry", url: primaryIPAPI, parse: parseFurryResp}},
+}
+
+func fetchIPInfoWithClient(ctx context.Context, client *http.Client, timeout time.Duration) (IPInfo, error) {
+	chain := improvedIPInfoChain
+	chain.timeout = timeout
+	return chain.Fetch(ctx, client, "")
+}
+
+// ============================================================
+// ProxyChain：improved 流水线专用的多跳上游代理链（-chain）
+// ============================================================
+
+// ProxyChain is the improved-pipeline counterpart of -upstream's
+// parseUpstreamChain/buildUpstreamDialer machinery in main.go: an ordered
+// list of hops, each tunneled through the previous one, built with
+// HTTPProxyDialerImproved for http/https hops and proxy.SOCKS5 for socks5
+// hops, so a candidate proxy can be validated as reached through a
+// known-good pre-hop (e.g. a corporate egress proxy).
+type ProxyChain struct {
+	hops []upstreamHop
+}
+
+// newProxyChain parses spec eagerly with the same comma-separated,
+// scheme-prefixed syntax as -upstream (see parseUpstreamChain), so a typo
+// in -chain is caught at startup rather than on the first probe. Unlike
+// -upstream there is no -upstream-mode fallback, so every hop must carry
+// an explicit scheme://. An empty spec yields a nil, nil chain.
+func newProxyChain(spec string) (*ProxyChain, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+	hops, err := parseUpstreamChain(spec, "", Auth{})
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyChain{hops: hops}, nil
+}
+
+// validateChainFlag does -chain's startup-time syntax check without
+// holding onto the parsed ProxyChain; main.go's -chain validation call
+// site uses this instead of newProxyChain directly so that non-linux
+// builds (where the improved pipeline doesn't exist) can supply their own
+// stand-in (see improvements_other.go).
+func validateChainFlag(spec string) error {
+	_, err := newProxyChain(spec)
+	return err
+}
+
+// buildChainHopDialer is buildHopDialer's improved-pipeline twin: it dials
+// http/https hops through HTTPProxyDialerImproved instead of
+// HTTPProxyDialer, so a chained hop gets the same TLS-handshake-timeout
+// and bufio-pool handling as the rest of this file. base is the previous
+// hop's dialer (nil for the first hop, which dials directly).
+func buildChainHopDialer(hop upstreamHop, timeout time.Duration,
+	base func(ctx context.Context, network, addr string) (net.Conn, error)) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+
+	switch hop.mode {
+	case "s5", "socks5":
+		var sAuth *proxy.Auth
+		if hop.auth.User != "" || hop.auth.Pass != "" {
+			sAuth = &proxy.Auth{User: hop.auth.User, Password: hop.auth.Pass}
+		}
+		var forward proxy.Dialer
+		if base != nil {
+			forward = contextDialer{DialContext: base}
+		} else {
+			forward = &net.Dialer{Timeout: timeout, KeepAlive: -1}
+		}
+		d, err := proxy.SOCKS5("tcp", hop.addr, sAuth, forward)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context, network, target string) (net.Conn, error) { return d.Dial(network, target) }, nil
+	case "http", "https":
+		var a *Auth
+		if hop.auth.User != "" || hop.auth.Pass != "" {
+			a = &hop.auth
+		}
+		hpd := &HTTPProxyDialerImproved{addr: hop.addr, auth: a, useTLS: hop.mode == "https", timeout: timeout, baseDial: base}
+		return hpd.DialContext, nil
+	default:
+		return nil, fmt.Errorf("unsupported chain hop mode: %s", hop.mode)
+	}
+}
+
+// Dial composes all hops into a single DialContext func, threading each
+// hop's timeout (and so its ctx deadline, see HTTPProxyDialerImproved) from
+// the first hop through to the last. A nil chain or an empty spec returns
+// (nil, nil), matching the test*Improved functions' "fall through to a
+// direct dial" convention for a nil upstreamDial.
+func (c *ProxyChain) Dial(timeout time.Duration) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if c == nil || len(c.hops) == 0 {
+		return nil, nil
+	}
+	var dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	for i, hop := range c.hops {
+		hopDial, err := buildChainHopDialer(hop, timeout, dial)
+		if err != nil {
+			return nil, fmt.Errorf("chain hop %d (%s): %w", i+1, hop.addr, err)
+		}
+		dial = hopDial
+	}
+	return dial, nil
+}
+
 // ============================================================
 // 改进的 SOCKS5 测试函数
 // ============================================================
 func testSocks5ProxyImproved(ctx context.Context, proxyAddr string, a Auth, timeout time.Duration,
-	upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error),
-	reqCounter *uint64) (IPInfo, int, error) {
+	chain *ProxyChain, reqCounter *uint64, limiter *rate.Limiter) (IPInfo, int, error) {
+
+	upstreamDial, err := chain.Dial(timeout)
+	if err != nil {
+		return IPInfo{}, 0, err
+	}
 
 	var forward proxy.Dialer
 	if upstreamDial != nil {
@@ -225,10 +348,10 @@ func testSocks5ProxyImproved(ctx context.Context, proxyAddr string, a Auth, time
 		tr.CloseIdleConnections()
 	}()
 
-	rt := countingRoundTripper{base: tr, counter: reqCounter}
+	rt := countingRoundTripper{base: tr, counter: reqCounter, limiter: limiter}
 	client := &http.Client{Transport: rt, Timeout: timeout}
 
-	info, err := fetchIPInfoWithClient(ctx, client)
+	info, err := fetchIPInfoWithClient(ctx, client, timeout)
 	return info, info.StatusCode, err
 }
 
@@ -236,8 +359,12 @@ func testSocks5ProxyImproved(ctx context.Context, proxyAddr string, a Auth, time
 // 改进的 HTTP 测试函数
 // ============================================================
 func testHTTPProxyImproved(ctx context.Context, proxyAddr string, a Auth, timeout time.Duration,
-	upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error),
-	reqCounter *uint64) (IPInfo, int, error) {
+	chain *ProxyChain, reqCounter *uint64, limiter *rate.Limiter) (IPInfo, int, error) {
+
+	upstreamDial, err := chain.Dial(timeout)
+	if err != nil {
+		return IPInfo{}, 0, err
+	}
 
 	proxyURL := (&url.URL{Scheme: "http", Host: proxyAddr})
 	if a.User != "" || a.Pass != "" {
@@ -279,10 +406,10 @@ func testHTTPProxyImproved(ctx context.Context, proxyAddr string, a Auth, timeou
 		tr.CloseIdleConnections()
 	}()
 
-	rt := countingRoundTripper{base: tr, counter: reqCounter}
+	rt := countingRoundTripper{base: tr, counter: reqCounter, limiter: limiter}
 	client := &http.Client{Transport: rt, Timeout: timeout}
 
-	info, err := fetchIPInfoWithClient(ctx, client)
+	info, err := fetchIPInfoWithClient(ctx, client, timeout)
 	return info, info.StatusCode, err
 }
 
@@ -290,8 +417,12 @@ func testHTTPProxyImproved(ctx context.Context, proxyAddr string, a Auth, timeou
 // 改进的 HTTPS 测试函数
 // ============================================================
 func testHTTPSProxyImproved(ctx context.Context, proxyAddr string, a Auth, timeout time.Duration,
-	upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error),
-	reqCounter *uint64) (IPInfo, int, error) {
+	chain *ProxyChain, reqCounter *uint64, limiter *rate.Limiter) (IPInfo, int, error) {
+
+	upstreamDial, err := chain.Dial(timeout)
+	if err != nil {
+		return IPInfo{}, 0, err
+	}
 
 	var cred *Auth
 	if a.User != "" || a.Pass != "" {
@@ -329,59 +460,633 @@ func testHTTPSProxyImproved(ctx context.Context, proxyAddr string, a Auth, timeo
 		tr.CloseIdleConnections()
 	}()
 
-	rt := countingRoundTripper{base: tr, counter: reqCounter}
+	rt := countingRoundTripper{base: tr, counter: reqCounter, limiter: limiter}
+	client := &http.Client{Transport: rt, Timeout: timeout}
+
+	info, err := fetchIPInfoWithClient(ctx, client, timeout)
+	return info, info.StatusCode, err
+}
+
+// ============================================================
+// 改进的 SOCKS4/4a 测试函数
+// ============================================================
+
+// testSocks4ProxyImproved mirrors testSocks4Proxy's handshake (socks4.go)
+// over the improved pipeline's dialer/transport conventions: x/net/proxy
+// has no SOCKS4 support, so socks4Dialer speaks the tiny VN/CD/DSTPORT/
+// DSTIP(+hostname for 4a)/USERID wire format directly.
+func testSocks4ProxyImproved(ctx context.Context, proxyAddr string, a Auth, timeout time.Duration,
+	chain *ProxyChain, reqCounter *uint64, limiter *rate.Limiter, socks4a bool) (IPInfo, int, error) {
+
+	upstreamDial, err := chain.Dial(timeout)
+	if err != nil {
+		return IPInfo{}, 0, err
+	}
+
+	var forward proxy.Dialer
+	if upstreamDial != nil {
+		forward = contextDialer{DialContext: upstreamDial}
+	} else {
+		forward = &net.Dialer{Timeout: timeout, KeepAlive: -1}
+	}
+
+	dialer := &socks4Dialer{proxyAddr: proxyAddr, userID: a.User, socks4a: socks4a, forward: forward}
+
+	tr := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if deadline, ok := ctx.Deadline(); ok {
+				_ = conn.SetDeadline(deadline)
+			}
+			return conn, nil
+		},
+		TLSClientConfig:        &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives:      true,
+		MaxIdleConns:           0,
+		MaxIdleConnsPerHost:    0,
+		MaxConnsPerHost:        1,
+		IdleConnTimeout:        1 * time.Millisecond, // 🔥 极短超时
+		ForceAttemptHTTP2:      false,
+		TLSHandshakeTimeout:    timeout,
+		ResponseHeaderTimeout:  timeout,
+		ExpectContinueTimeout:  500 * time.Millisecond,
+		DisableCompression:     true,
+		MaxResponseHeaderBytes: 1 * 1024,
+		WriteBufferSize:        1 * 1024,
+		ReadBufferSize:         1 * 1024,
+	}
+
+	defer func() {
+		tr.CloseIdleConnections()
+		time.Sleep(5 * time.Millisecond)
+		tr.CloseIdleConnections()
+	}()
+
+	rt := countingRoundTripper{base: tr, counter: reqCounter, limiter: limiter}
 	client := &http.Client{Transport: rt, Timeout: timeout}
 
-	info, err := fetchIPInfoWithClient(ctx, client)
+	info, err := fetchIPInfoWithClient(ctx, client, timeout)
 	return info, info.StatusCode, err
 }
 
+// ============================================================
+// 改进的 SOCKS5 UDP ASSOCIATE 测试函数
+// ============================================================
+
+// dnsProbeTarget/dnsProbeDomain/dnsProbeID describe the fixed DNS query
+// testSocks5UDPProxyImproved relays through the proxy's UDP ASSOCIATE
+// endpoint: a bare ASSOCIATE success reply only proves the proxy accepted
+// the request, not that it actually forwards datagrams in both
+// directions, so we round-trip a real query and check the transaction ID
+// comes back.
+const (
+	dnsProbeTarget = "8.8.8.8:53"
+	dnsProbeDomain = "www.example.com"
+	dnsProbeID     = uint16(0x1a2b)
+)
+
+// buildDNSQuery encodes a minimal standard-query DNS packet for an A
+// record of domain, with the given 16-bit transaction id.
+func buildDNSQuery(id uint16, domain string) []byte {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, id)
+	buf.Write([]byte{0x01, 0x00})                         // flags: standard query, recursion desired
+	buf.Write([]byte{0x00, 0x01})                         // QDCOUNT=1
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) // ANCOUNT/NSCOUNT/ARCOUNT=0
+	for _, label := range strings.Split(domain, ".") {
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+	buf.Write([]byte{0x00, 0x01}) // QTYPE=A
+	buf.Write([]byte{0x00, 0x01}) // QCLASS=IN
+	return buf.Bytes()
+}
+
+// socks5UDPAssociate performs the SOCKS5 greeting and UDP ASSOCIATE
+// handshake over conn (already connected to the proxy's TCP control
+// port) and returns the relay address subsequent datagrams must target.
+func socks5UDPAssociate(conn net.Conn, a Auth) (*net.UDPAddr, error) {
+	authMethod := byte(0x00)
+	if a.User != "" || a.Pass != "" {
+		authMethod = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, authMethod}); err != nil {
+		return nil, err
+	}
+	var methodReply [2]byte
+	if _, err := io.ReadFull(conn, methodReply[:]); err != nil {
+		return nil, err
+	}
+	if methodReply[0] != 0x05 {
+		return nil, fmt.Errorf("socks5-udp: bad version 0x%02x in method reply", methodReply[0])
+	}
+	switch methodReply[1] {
+	case 0x00:
+	case 0x02:
+		if authMethod != 0x02 {
+			return nil, fmt.Errorf("socks5-udp: proxy requires auth but none was supplied")
+		}
+		req := append([]byte{0x01, byte(len(a.User))}, []byte(a.User)...)
+		req = append(req, byte(len(a.Pass)))
+		req = append(req, []byte(a.Pass)...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		var authReply [2]byte
+		if _, err := io.ReadFull(conn, authReply[:]); err != nil {
+			return nil, err
+		}
+		if authReply[1] != 0x00 {
+			return nil, fmt.Errorf("socks5-udp: auth rejected")
+		}
+	default:
+		return nil, fmt.Errorf("socks5-udp: no acceptable auth method (server chose 0x%02x)", methodReply[1])
+	}
+
+	if _, err := conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	if head[1] != 0x00 {
+		return nil, fmt.Errorf("socks5-udp: associate rejected, REP=0x%02x", head[1])
+	}
+
+	var bndIP net.IP
+	switch head[3] {
+	case 0x01:
+		var ip4 [4]byte
+		if _, err := io.ReadFull(conn, ip4[:]); err != nil {
+			return nil, err
+		}
+		bndIP = net.IP(ip4[:])
+	case 0x04:
+		var ip6 [16]byte
+		if _, err := io.ReadFull(conn, ip6[:]); err != nil {
+			return nil, err
+		}
+		bndIP = net.IP(ip6[:])
+	default:
+		return nil, fmt.Errorf("socks5-udp: unsupported BND.ADDR type 0x%02x", head[3])
+	}
+	var portBuf [2]byte
+	if _, err := io.ReadFull(conn, portBuf[:]); err != nil {
+		return nil, err
+	}
+	port := binary.BigEndian.Uint16(portBuf[:])
+
+	relayIP := bndIP
+	if relayIP.IsUnspecified() {
+		// 不少代理在 BND.ADDR 上返回 0.0.0.0，表示复用 TCP 控制连接的对端地址
+		if host, _, splitErr := net.SplitHostPort(conn.RemoteAddr().String()); splitErr == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				relayIP = ip
+			}
+		}
+	}
+	return &net.UDPAddr{IP: relayIP, Port: int(port)}, nil
+}
+
+// wrapSocks5UDP prefixes payload with the SOCKS5 UDP request header
+// (RSV=0, FRAG=0, target ATYP/ADDR/PORT) so the relay knows where to
+// forward it on.
+func wrapSocks5UDP(target *net.UDPAddr, payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0}) // RSV, FRAG
+	if ip4 := target.IP.To4(); ip4 != nil {
+		buf.WriteByte(0x01)
+		buf.Write(ip4)
+	} else {
+		buf.WriteByte(0x04)
+		buf.Write(target.IP.To16())
+	}
+	_ = binary.Write(&buf, binary.BigEndian, uint16(target.Port))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// testSocks5UDPProxyImproved validates SOCKS5 UDP ASSOCIATE support by
+// associating a relay and round-tripping a DNS query through it. There is
+// no IPInfo to fetch here (UDP relay, not an HTTP CONNECT), so success is
+// just "the relay forwarded our datagram and the reply came back", hence
+// the plain (statusCode, error) return instead of (IPInfo, int, error).
+func testSocks5UDPProxyImproved(ctx context.Context, proxyAddr string, a Auth, timeout time.Duration,
+	chain *ProxyChain, reqCounter *uint64) (int, error) {
+
+	upstreamDial, err := chain.Dial(timeout)
+	if err != nil {
+		return 0, err
+	}
+	var dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	if upstreamDial != nil {
+		dial = upstreamDial
+	} else {
+		nd := &net.Dialer{Timeout: timeout, KeepAlive: -1}
+		dial = nd.DialContext
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := dial(dialCtx, "tcp", proxyAddr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+
+	if reqCounter != nil {
+		atomic.AddUint64(reqCounter, 1)
+	}
+
+	relay, err := socks5UDPAssociate(conn, a)
+	if err != nil {
+		return 0, err
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		return 0, fmt.Errorf("socks5-udp: dial relay %s: %w", relay, err)
+	}
+	defer udpConn.Close()
+	_ = udpConn.SetDeadline(time.Now().Add(timeout))
+
+	dnsTarget, err := net.ResolveUDPAddr("udp", dnsProbeTarget)
+	if err != nil {
+		return 0, err
+	}
+	query := buildDNSQuery(dnsProbeID, dnsProbeDomain)
+	if _, err := udpConn.Write(wrapSocks5UDP(dnsTarget, query)); err != nil {
+		return 0, fmt.Errorf("socks5-udp: send probe: %w", err)
+	}
+
+	buf := make([]byte, 512)
+	n, err := udpConn.Read(buf)
+	if err != nil {
+		return 0, fmt.Errorf("socks5-udp: read relay response: %w", err)
+	}
+
+	const minHeader = 4 // RSV(2)+FRAG(1)+ATYP(1)
+	if n < minHeader {
+		return 0, fmt.Errorf("socks5-udp: short relay response (%d bytes)", n)
+	}
+	hdrLen := minHeader
+	switch buf[3] {
+	case 0x01:
+		hdrLen += 4 + 2
+	case 0x04:
+		hdrLen += 16 + 2
+	case 0x03:
+		if n < minHeader+1 {
+			return 0, fmt.Errorf("socks5-udp: truncated domain-name response header")
+		}
+		hdrLen += 1 + int(buf[4]) + 2
+	default:
+		return 0, fmt.Errorf("socks5-udp: unsupported response ATYP 0x%02x", buf[3])
+	}
+	if n < hdrLen+12 {
+		return 0, fmt.Errorf("socks5-udp: relay response truncated (%d bytes)", n)
+	}
+
+	dnsReply := buf[hdrLen:n]
+	gotID := binary.BigEndian.Uint16(dnsReply[0:2])
+	if gotID != dnsProbeID {
+		return 0, fmt.Errorf("socks5-udp: DNS reply transaction ID mismatch (got 0x%04x)", gotID)
+	}
+	flags := binary.BigEndian.Uint16(dnsReply[2:4])
+	if flags&0x8000 == 0 {
+		return 0, fmt.Errorf("socks5-udp: reply is not a DNS response (flags=0x%04x)", flags)
+	}
+	return 200, nil
+}
+
 // ============================================================
 // 改进的 testOne 函数，使用改进的测试函数
 // ============================================================
+// testOneImproved 复用主流程（testOne）已有的令牌桶限速与熔断器：limiter 在
+// 每次 HTTP RoundTrip 前排队等待，breakers 在连续失败超过阈值后让同一 host
+// 的后续探测直接短路返回 errBreakerOpen，避免一批已死的端点占满 worker。
+// metrics（可为 nil，即 --metrics-addr 未启用）记录每次实际发起的探测耗时与
+// 按 ProxyType/Country 的成功计数，供 /metrics 暴露；aimd（可为 nil）把同一
+// 次结果喂给 startDynamicLimiterImproved 的 AIMD 并发上限；熔断器短路的请求
+// 不算一次探测，两者都不计入。
 func testOneImproved(proxyType string, proxyAddr string, a Auth, timeout time.Duration,
-	upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error),
-	reqCounter *uint64) Result {
+	chain *ProxyChain, reqCounter *uint64, limiter *rate.Limiter, breakers *BreakerRegistry, metrics *ImprovedMetrics, aimd *aimdLimiter) Result {
+
+	host := hostFromHostPort(proxyAddr)
+	if breakers != nil && !breakers.Allow(host) {
+		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: strings.ToUpper(proxyType), Success: false, Err: errBreakerOpen}
+	}
 
+	attemptStart := time.Now()
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
+	var result Result
 	switch proxyType {
 	case "http":
-		info, _, err := testHTTPProxyImproved(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter)
+		info, _, err := testHTTPProxyImproved(ctx, proxyAddr, a, timeout, chain, reqCounter, limiter)
 		if err != nil {
-			return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTP", Success: false, Err: err, StatusCode: info.StatusCode}
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTP", Success: false, Err: err, StatusCode: info.StatusCode}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTP", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
 		}
-		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTP", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
 	case "https":
-		info, _, err := testHTTPSProxyImproved(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter)
+		info, _, err := testHTTPSProxyImproved(ctx, proxyAddr, a, timeout, chain, reqCounter, limiter)
 		if err != nil {
-			return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTPS", Success: false, Err: err, StatusCode: info.StatusCode}
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTPS", Success: false, Err: err, StatusCode: info.StatusCode}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTPS", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
 		}
-		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTPS", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
 	case "socks5":
-		info, _, err := testSocks5ProxyImproved(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter)
+		info, _, err := testSocks5ProxyImproved(ctx, proxyAddr, a, timeout, chain, reqCounter, limiter)
+		if err != nil {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5", Success: false, Err: err, StatusCode: info.StatusCode}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
+		}
+	case "socks4", "socks4a":
+		info, _, err := testSocks4ProxyImproved(ctx, proxyAddr, a, timeout, chain, reqCounter, limiter, proxyType == "socks4a")
+		if err != nil {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: strings.ToUpper(proxyType), Success: false, Err: err, StatusCode: info.StatusCode}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: strings.ToUpper(proxyType), Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
+		}
+	case "socks5-udp":
+		status, err := testSocks5UDPProxyImproved(ctx, proxyAddr, a, timeout, chain, reqCounter)
 		if err != nil {
-			return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5", Success: false, Err: err, StatusCode: info.StatusCode}
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5-UDP", Success: false, Err: err, StatusCode: status}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5-UDP", Success: true, StatusCode: status}
 		}
-		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
 	default:
 		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: strings.ToUpper(proxyType), Success: false, Err: fmt.Errorf("unknown proxy type: %s", proxyType)}
 	}
+
+	if breakers != nil {
+		breakers.RecordResult(host, result.Success, classifyErr(result.Err))
+	}
+	metrics.RecordAttempt(result.ProxyType, result.Success, result.Country, time.Since(attemptStart))
+	aimd.RecordOutcome(result.Success)
+	return result
 }
 
 // ============================================================
-// 改进的动态限制器：基于 RSS 而非 HeapAlloc
+// cgroup 感知的内存上限检测（容器场景）
 // ============================================================
-func startDynamicLimiterImproved(workers int, memLimit int64, dynamicLimit *int64, active *uint64) {
+
+// cgroupMemInfo is what detectCgroupMemImproved found: the hierarchy it
+// used, the configured limit, and the current usage as reported by the
+// cgroup itself (memory.current/usage_in_bytes) — unlike RSS, that figure
+// also reflects the page-cache pressure the kernel OOM killer actually
+// sees.
+type cgroupMemInfo struct {
+	limit  int64
+	used   int64
+	source string // "cgroupv2:<path>" / "cgroupv1:<path>"
+}
+
+// detectCgroupMemImproved walks /proc/self/cgroup to find this process's
+// cgroup path, then reads memory.max (+memory.current) under the v2
+// unified hierarchy at /sys/fs/cgroup/<path>, falling back to the v1
+// memory controller's memory.limit_in_bytes (+usage_in_bytes) under
+// /sys/fs/cgroup/memory/<path>. ok is false when cgroups aren't in use, or
+// the limit is "max" (unbounded).
+func detectCgroupMemImproved() (info cgroupMemInfo, ok bool) {
+	path := cgroupSelfPath()
+
+	if v, readOK := readCgroupFileInt("/sys/fs/cgroup" + path + "/memory.max"); readOK {
+		used, _ := readCgroupFileInt("/sys/fs/cgroup" + path + "/memory.current")
+		return cgroupMemInfo{limit: v, used: used, source: "cgroupv2:" + path}, true
+	}
+	if v, readOK := readCgroupFileInt("/sys/fs/cgroup/memory" + path + "/memory.limit_in_bytes"); readOK && v < 1<<62 {
+		used, _ := readCgroupFileInt("/sys/fs/cgroup/memory" + path + "/memory.usage_in_bytes")
+		return cgroupMemInfo{limit: v, used: used, source: "cgroupv1:" + path}, true
+	}
+	return cgroupMemInfo{}, false
+}
+
+// cgroupSelfPath parses /proc/self/cgroup for this process's cgroup path.
+// Each line is "hierarchy-ID:controller-list:path"; a v2 unified-hierarchy
+// entry has an empty controller list ("0::/path"), a v1 entry names
+// "memory" among its controller list. Falls back to "" (cgroup root) when
+// unreadable, which is also correct for the common container case where
+// the container's own cgroup is bind-mounted directly at /sys/fs/cgroup.
+func cgroupSelfPath() string {
+	b, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+	var v2Path string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		controllers, p := parts[1], parts[2]
+		if controllers == "" {
+			v2Path = p
+			continue
+		}
+		for _, c := range strings.Split(controllers, ",") {
+			if c == "memory" {
+				return p
+			}
+		}
+	}
+	return v2Path
+}
+
+func readCgroupFileInt(path string) (int64, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	txt := strings.TrimSpace(string(b))
+	if txt == "" || txt == "max" {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(txt, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+// resolveImprovedMemLimit combines a user-supplied memLimit (0/negative
+// means "auto") with the cgroup-detected one: with no user limit, the
+// cgroup limit (if any) wins outright; with both present, the effective
+// ceiling is min(userLimit, cgroup limit) so a generous manual setting
+// can't override a tighter container quota. Returns (0, "none") when
+// neither source is available.
+func resolveImprovedMemLimit(userLimit int64) (int64, string) {
+	cg, ok := detectCgroupMemImproved()
+	switch {
+	case ok && userLimit > 0:
+		if cg.limit < userLimit {
+			return cg.limit, cg.source
+		}
+		return userLimit, "user-supplied"
+	case ok:
+		return cg.limit, cg.source
+	case userLimit > 0:
+		return userLimit, "user-supplied"
+	default:
+		return 0, "none"
+	}
+}
+
+// improvedUsedMemBytes returns the best available "memory actually in
+// use" figure: the cgroup's memory.current/usage_in_bytes when available
+// (reflects the page-cache pressure the OOM killer sees, which plain RSS
+// excludes), falling back to RSS, then Go's own HeapAlloc when neither is
+// readable (e.g. running directly on a host, outside any cgroup).
+func improvedUsedMemBytes() int64 {
+	if cg, ok := detectCgroupMemImproved(); ok && cg.used > 0 {
+		return cg.used
+	}
+	if rss := readProcessRSS(); rss > 0 {
+		return rss
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapAlloc)
+}
+
+// ============================================================
+// AIMD：按错误率而非内存压力调节并发上限
+// ============================================================
+//
+// startDynamicLimiterImproved 原来只看 RSS/cgroup 用量，这在目标 IP 信息
+// 接口开始限流、或代理列表里大半已经失效时完全看不出异常——内存毫无压力，
+// 但 worker 都在排队等一个注定失败的请求。aimdLimiter 用最近 aimdWindowSize
+// 次 testOneImproved 结果算出的失败率来单独收紧/放宽并发上限，采用 TCP 拥塞
+// 控制那套加性增、乘性减的节奏：失败率冲过高水位就乘 aimdDecreaseMul，低于
+// 低水位且稳定够久就加 aimdIncreaseStep。最终写入 dynamicLimit 的值取内存
+// 上限与 AIMD 上限中较小的一个。
+const (
+	aimdWindowSize   = 500
+	aimdHighWater    = 0.6
+	aimdLowWater     = 0.3
+	aimdDecreaseMul  = 0.7
+	aimdIncreaseStep = 2
+	aimdMinCeiling   = 2
+	aimdGrowInterval = 2 * time.Second // 加性上升的最短间隔，避免和内存环路互相拉扯
+)
+
+// aimdLimiter is testOneImproved's feedback loop into concurrency control:
+// RecordOutcome feeds one completion into a fixed-size sliding window,
+// Ceiling reports the AIMD-derived cap that startDynamicLimiterImproved
+// combines (via min) with its own memory-derived cap.
+type aimdLimiter struct {
+	mu     sync.Mutex
+	window []bool // ring buffer of last aimdWindowSize outcomes, true=success
+	pos    int
+	filled int
+
+	ceiling    int64
+	maxCeiling int64 // set each tick by startDynamicLimiterImproved's memory loop
+	lastGrow   time.Time
+}
+
+// newAIMDLimiter seeds the ceiling at initial (normally -concurrency),
+// unconstrained until the memory loop calls SetMaxCeiling for the first
+// time.
+func newAIMDLimiter(initial int64) *aimdLimiter {
+	return &aimdLimiter{window: make([]bool, aimdWindowSize), ceiling: initial, maxCeiling: initial}
+}
+
+// SetMaxCeiling records the memory-derived cap for this tick, so a grow
+// step never pushes the AIMD ceiling above what memory pressure already
+// allows.
+func (a *aimdLimiter) SetMaxCeiling(v int64) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.maxCeiling = v
+}
+
+// RecordOutcome feeds one testOneImproved completion (success/failure,
+// including timeouts) into the sliding window and, once the window has
+// filled at least once, adjusts ceiling when a watermark is crossed.
+func (a *aimdLimiter) RecordOutcome(success bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.window[a.pos] = success
+	a.pos = (a.pos + 1) % aimdWindowSize
+	if a.filled < aimdWindowSize {
+		a.filled++
+		return // 窗口没填满之前样本太少，先不做判断
+	}
+
+	fails := 0
+	for _, ok := range a.window {
+		if !ok {
+			fails++
+		}
+	}
+	failRatio := float64(fails) / float64(aimdWindowSize)
+
+	switch {
+	case failRatio > aimdHighWater:
+		newCeil := int64(float64(a.ceiling) * aimdDecreaseMul)
+		if newCeil < aimdMinCeiling {
+			newCeil = aimdMinCeiling
+		}
+		if newCeil != a.ceiling {
+			log.Printf("🔥 AIMD: 失败率 %.0f%% 超过高水位 %.0f%%，并发上限 %d -> %d", failRatio*100, aimdHighWater*100, a.ceiling, newCeil)
+		}
+		a.ceiling = newCeil
+	case failRatio < aimdLowWater:
+		if time.Since(a.lastGrow) >= aimdGrowInterval {
+			newCeil := a.ceiling + aimdIncreaseStep
+			if newCeil > a.maxCeiling {
+				newCeil = a.maxCeiling
+			}
+			a.ceiling = newCeil
+			a.lastGrow = time.Now()
+		}
+	}
+}
+
+// Ceiling returns the current AIMD-derived concurrency cap. A nil limiter
+// (AIMD not wired in) imposes no cap.
+func (a *aimdLimiter) Ceiling() int64 {
+	if a == nil {
+		return 1<<63 - 1
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.ceiling
+}
+
+// ============================================================
+// 改进的动态限制器：基于 RSS/cgroup 而非 HeapAlloc，并受 AIMD 上限约束
+// ============================================================
+func startDynamicLimiterImproved(workers int, memLimit int64, dynamicLimit *int64, active *uint64, metrics *ImprovedMetrics, aimd *aimdLimiter) {
 	if workers <= 0 || dynamicLimit == nil || active == nil {
 		return
 	}
 	atomic.StoreInt64(dynamicLimit, int64(workers))
+	metrics.bindLimiter(dynamicLimit, active)
 
-	if memLimit <= 0 {
+	effLimit, src := resolveImprovedMemLimit(memLimit)
+	if effLimit <= 0 {
 		return
 	}
+	metrics.SetMemLimit(effLimit)
+	log.Printf("改进版动态限制器：内存上限 = %s（来源=%s）", humanBytes(effLimit), src)
 
 	go func() {
 		const interval = 100 * time.Millisecond
@@ -390,16 +1095,7 @@ func startDynamicLimiterImproved(workers int, memLimit int64, dynamicLimit *int6
 		for {
 			time.Sleep(interval)
 
-			// 🔥 优先使用 RSS，fallback 到 HeapAlloc
-			rss := readProcessRSS()
-			var usedRatio float64
-			if rss > 0 {
-				usedRatio = float64(rss) / float64(memLimit)
-			} else {
-				var ms runtime.MemStats
-				runtime.ReadMemStats(&ms)
-				usedRatio = float64(ms.HeapAlloc) / float64(memLimit)
-			}
+			usedRatio := float64(improvedUsedMemBytes()) / float64(effLimit)
 
 			cur := atomic.LoadInt64(dynamicLimit)
 			newLimit := cur
@@ -443,6 +1139,13 @@ func startDynamicLimiterImproved(workers int, memLimit int64, dynamicLimit *int6
 				newLimit = int64(workers)
 			}
 
+			// AIMD 把内存环路这一轮算出的上限当作自己的增长天花板，最终写回
+			// dynamicLimit 的是两者中较小的一个（min(memoryLimit, aimdLimit)）。
+			aimd.SetMaxCeiling(newLimit)
+			if ac := aimd.Ceiling(); ac < newLimit {
+				newLimit = ac
+			}
+
 			if newLimit != cur {
 				atomic.StoreInt64(dynamicLimit, newLimit)
 			}
@@ -461,25 +1164,20 @@ func startDynamicLimiterImproved(workers int, memLimit int64, dynamicLimit *int6
 // 改进的内存回收器
 // ============================================================
 func startMemReclaimerImproved(memLimit int64) {
-	if memLimit <= 0 {
+	effLimit, src := resolveImprovedMemLimit(memLimit)
+	if effLimit <= 0 {
 		return
 	}
+	log.Printf("改进版内存回收器：内存上限 = %s（来源=%s）", humanBytes(effLimit), src)
 
-	// 🔥 基于 RSS 的更激进策略
+	// 🔥 基于 RSS/cgroup 用量的更激进策略
 	go func() {
 		ticker := time.NewTicker(500 * time.Millisecond)
 		defer ticker.Stop()
 
 		for range ticker.C {
-			rss := readProcessRSS()
-			if rss == 0 {
-				var ms runtime.MemStats
-				runtime.ReadMemStats(&ms)
-				rss = int64(ms.HeapAlloc)
-			}
-
-			// 当 RSS 达到限制的 60% 时主动释放
-			if rss > int64(float64(memLimit)*0.60) {
+			// 当用量达到上限的 60% 时主动释放
+			if improvedUsedMemBytes() > int64(float64(effLimit)*0.60) {
 				debug.FreeOSMemory()
 				runtime.GC()
 			}
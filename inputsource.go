@@ -0,0 +1,482 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// stringList collects repeated occurrences of a flag (e.g. -in a -in b) into
+// a slice; flag.Var needs a flag.Value, which flag.String can't give us for
+// a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// inputSourceCheckpointLines is how often feedInputSources persists a
+// source's byte offset to -state: often enough that -resume doesn't replay
+// much of a large source, rare enough to not dominate BoltDB writes.
+const inputSourceCheckpointLines = 2000
+
+// InputSource is one line-oriented origin of raw proxy input lines: a local
+// file, stdin, a streamed HTTP(S) URL, or one entry inside a zip/tar(.gz)
+// archive. resolveInputSpecs expands a single -in value (which may be a glob
+// or archive) into one or more of these.
+type InputSource interface {
+	// Name identifies the source for skipReasons ("src_http_500") and
+	// -state offset checkpoints; stable across runs for the same input.
+	Name() string
+
+	// Open returns a reader starting at offset bytes into the source (0 =
+	// from the start). Sources that can't resume (stdin, archive entries)
+	// ignore offset and always read from the start.
+	Open(ctx context.Context, offset int64) (io.ReadCloser, error)
+
+	// Countable reports whether Len can be trusted for the -progress
+	// total/ETA without fully consuming the source first.
+	Countable() bool
+}
+
+// resolveInputSpecs expands -in values (or, if none were given, the legacy
+// -ip file) into concrete InputSources. Recognized prefixes: "-" (stdin),
+// "file:path", "glob:pattern", "zip:path", "tar:path", "http(s)://url"; a
+// bare path with none of these prefixes is treated as "file:".
+func resolveInputSpecs(specs []string, legacyFile string) ([]InputSource, error) {
+	if len(specs) == 0 {
+		if strings.TrimSpace(legacyFile) == "" {
+			return nil, fmt.Errorf("no -in given and -ip is empty")
+		}
+		specs = []string{legacyFile}
+	}
+
+	var out []InputSource
+	for _, spec := range specs {
+		switch {
+		case spec == "-":
+			out = append(out, stdinSource{})
+		case strings.HasPrefix(spec, "file:"):
+			out = append(out, fileSource{path: strings.TrimPrefix(spec, "file:")})
+		case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+			out = append(out, httpSource{url: spec})
+		case strings.HasPrefix(spec, "glob:"):
+			matches, err := filepath.Glob(strings.TrimPrefix(spec, "glob:"))
+			if err != nil {
+				return nil, fmt.Errorf("bad -in glob %q: %w", spec, err)
+			}
+			sort.Strings(matches)
+			for _, m := range matches {
+				out = append(out, fileSource{path: m})
+			}
+		case strings.HasPrefix(spec, "zip:"):
+			entries, err := zipEntries(strings.TrimPrefix(spec, "zip:"))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, entries...)
+		case strings.HasPrefix(spec, "tar:"):
+			entries, err := tarEntries(strings.TrimPrefix(spec, "tar:"))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, entries...)
+		default:
+			out = append(out, fileSource{path: spec})
+		}
+	}
+	return out, nil
+}
+
+// fileSource is a plain local file, the same as the original single -ip
+// file this generalizes from.
+type fileSource struct{ path string }
+
+func (s fileSource) Name() string      { return "file:" + s.path }
+func (s fileSource) Countable() bool   { return true }
+func (s fileSource) Open(_ context.Context, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// stdinSource reads "-": can't be seeked or re-read, so offset/resume is a
+// no-op and it's never counted ahead of time.
+type stdinSource struct{}
+
+func (stdinSource) Name() string    { return "stdin" }
+func (stdinSource) Countable() bool { return false }
+func (stdinSource) Open(context.Context, int64) (io.ReadCloser, error) {
+	return io.NopCloser(os.Stdin), nil
+}
+
+// httpSource streams a remote list over GET, resuming via Range when offset
+// > 0 and transparently ungzipping when the server says it's gzipped (or
+// the URL just ends in .gz, for dumb static hosts that don't set
+// Content-Encoding). Not countable: counting it would mean downloading it
+// twice.
+type httpSource struct{ url string }
+
+func (s httpSource) Name() string    { return "http:" + s.url }
+func (httpSource) Countable() bool   { return false }
+func (s httpSource) Open(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("src_http_%d", resp.StatusCode)
+	}
+
+	gzipped := resp.Header.Get("Content-Encoding") == "gzip" || strings.HasSuffix(s.url, ".gz")
+	if !gzipped {
+		return resp.Body, nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("src_http_gzip: %w", err)
+	}
+	return gzipReadCloser{gz: gz, body: resp.Body}, nil
+}
+
+// gzipReadCloser closes both the gzip.Reader and the underlying HTTP body;
+// closing only one would either leak the connection or double-free.
+type gzipReadCloser struct {
+	gz   *gzip.Reader
+	body io.ReadCloser
+}
+
+func (g gzipReadCloser) Read(p []byte) (int, error) { return g.gz.Read(p) }
+func (g gzipReadCloser) Close() error {
+	_ = g.gz.Close()
+	return g.body.Close()
+}
+
+// zipEntrySource is one non-directory file inside a zip archive. Archives
+// are small enough in practice that offset-resume isn't worth the extra
+// complexity of tracking per-entry decompressed byte offsets, so Open
+// always starts from the entry's beginning.
+type zipEntrySource struct {
+	archivePath string
+	entryName   string
+}
+
+func (s zipEntrySource) Name() string    { return "zip:" + s.archivePath + "#" + s.entryName }
+func (zipEntrySource) Countable() bool   { return false }
+func (s zipEntrySource) Open(context.Context, int64) (io.ReadCloser, error) {
+	r, err := zip.OpenReader(s.archivePath)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range r.File {
+		if f.Name != s.entryName {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return zipEntryReadCloser{rc: rc, archive: r}, nil
+	}
+	r.Close()
+	return nil, fmt.Errorf("zip entry %q not found in %s", s.entryName, s.archivePath)
+}
+
+type zipEntryReadCloser struct {
+	rc      io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (z zipEntryReadCloser) Read(p []byte) (int, error) { return z.rc.Read(p) }
+func (z zipEntryReadCloser) Close() error {
+	_ = z.rc.Close()
+	return z.archive.Close()
+}
+
+// zipEntries lists every non-directory entry of a zip archive as its own
+// InputSource.
+func zipEntries(path string) ([]InputSource, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("open zip %s: %w", path, err)
+	}
+	defer r.Close()
+
+	var out []InputSource
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		out = append(out, zipEntrySource{archivePath: path, entryName: f.Name})
+	}
+	return out, nil
+}
+
+// tarEntrySource is one regular file inside a tar or tar.gz archive,
+// identified by its index among non-directory entries (tar has no random
+// access, so re-reading one means re-scanning the archive from the start
+// and skipping to the Nth regular entry — fine for the archive sizes this
+// flag is meant for).
+type tarEntrySource struct {
+	archivePath string
+	name        string
+	index       int
+}
+
+func (s tarEntrySource) Name() string  { return "tar:" + s.archivePath + "#" + s.name }
+func (tarEntrySource) Countable() bool { return false }
+func (s tarEntrySource) Open(context.Context, int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.archivePath)
+	if err != nil {
+		return nil, err
+	}
+	tr, closeExtra, err := openTarReader(f, s.archivePath)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	i := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			f.Close()
+			return nil, fmt.Errorf("tar entry %q not found in %s", s.name, s.archivePath)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if i == s.index {
+			return tarEntryReadCloser{tr: tr, f: f, extra: closeExtra}, nil
+		}
+		i++
+	}
+}
+
+// openTarReader wraps f in a tar.Reader, transparently gunzipping first for
+// .tgz/.tar.gz paths. closeExtra, if non-nil, is the gzip.Reader that also
+// needs closing alongside f.
+func openTarReader(f *os.File, path string) (*tar.Reader, io.Closer, error) {
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), gz, nil
+	}
+	return tar.NewReader(f), nil, nil
+}
+
+type tarEntryReadCloser struct {
+	tr    *tar.Reader
+	f     *os.File
+	extra io.Closer
+}
+
+func (t tarEntryReadCloser) Read(p []byte) (int, error) { return t.tr.Read(p) }
+func (t tarEntryReadCloser) Close() error {
+	if t.extra != nil {
+		_ = t.extra.Close()
+	}
+	return t.f.Close()
+}
+
+// tarEntries lists every regular-file entry of a tar/tar.gz archive as its
+// own InputSource, in archive order.
+func tarEntries(path string) ([]InputSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open tar %s: %w", path, err)
+	}
+	defer f.Close()
+
+	tr, extra, err := openTarReader(f, path)
+	if err != nil {
+		return nil, fmt.Errorf("open tar %s: %w", path, err)
+	}
+	if extra != nil {
+		defer extra.Close()
+	}
+
+	var out []InputSource
+	i := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read tar %s: %w", path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		out = append(out, tarEntrySource{archivePath: path, name: hdr.Name, index: i})
+		i++
+	}
+	return out, nil
+}
+
+// sourceLine is one raw line from one InputSource, tagged so the consumer
+// can tell which source a bad line or skip came from if it ever needs to.
+type sourceLine struct {
+	source string
+	raw    string
+}
+
+// countInputSources sums Len() over every countable source, for the
+// -progress total/ETA. Uncountable sources (stdin, http, archives) aren't
+// pre-scanned — they contribute 0, same as this tool already undercounting
+// total when given a plain file it can't open.
+func countInputSources(sources []InputSource) int64 {
+	var total int64
+	for _, s := range sources {
+		fs, ok := s.(fileSource)
+		if !ok || !s.Countable() {
+			continue
+		}
+		n, err := countWorkItems(fs.path)
+		if err != nil {
+			continue
+		}
+		total += n
+	}
+	return total
+}
+
+// allSourcesCountable reports whether every source supports an upfront Len,
+// i.e. whether total==0 really does mean "nothing to do" rather than just
+// "some source couldn't be pre-scanned".
+func allSourcesCountable(sources []InputSource) bool {
+	for _, s := range sources {
+		if !s.Countable() {
+			return false
+		}
+	}
+	return true
+}
+
+// feedInputSources consumes every source concurrently (bounded by
+// concurrency) and multiplexes their lines into out, closing out once all
+// sources are drained. A source that fails to open at all is recorded once
+// in skipReasons (e.g. "src_http_500") rather than silently dropped.
+func feedInputSources(ctx context.Context, sources []InputSource, concurrency int, stateStore *StateStore, out chan<- sourceLine, skipReasons *CounterMap) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, src := range sources {
+		src := src
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			consumeInputSource(ctx, src, stateStore, out, skipReasons)
+		}()
+	}
+	wg.Wait()
+	close(out)
+}
+
+// consumeInputSource reads one source line by line, periodically
+// checkpointing its byte offset to stateStore (when non-nil) so -resume can
+// Range/Seek past already-consumed bytes of file:/http: sources instead of
+// restarting them from scratch.
+func consumeInputSource(ctx context.Context, src InputSource, stateStore *StateStore, out chan<- sourceLine, skipReasons *CounterMap) {
+	var offset int64
+	if stateStore != nil {
+		if off, ok := stateStore.LoadSourceOffset(src.Name()); ok {
+			offset = off
+		}
+	}
+
+	rc, err := src.Open(ctx, offset)
+	if err != nil {
+		skipReasons.Inc(classifySourceErr(err))
+		return
+	}
+	defer rc.Close()
+
+	counting := &countingReader{r: rc}
+	sc := bufio.NewScanner(counting)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	lines := 0
+	for sc.Scan() {
+		out <- sourceLine{source: src.Name(), raw: sc.Text()}
+		lines++
+		if stateStore != nil && lines%inputSourceCheckpointLines == 0 {
+			_ = stateStore.SaveSourceOffset(src.Name(), offset+counting.n)
+		}
+	}
+	if stateStore != nil {
+		_ = stateStore.SaveSourceOffset(src.Name(), offset+counting.n)
+	}
+	if err := sc.Err(); err != nil {
+		skipReasons.Inc("src_scan_err")
+	}
+}
+
+// classifySourceErr turns an Open() failure into a skipReasons key: httpSource
+// already formats its own "src_http_<status>"/"src_http_gzip" errors, so this
+// only needs a generic fallback for file/archive open failures.
+func classifySourceErr(err error) string {
+	msg := err.Error()
+	if strings.HasPrefix(msg, "src_http_") {
+		if i := strings.IndexByte(msg, ':'); i >= 0 {
+			return msg[:i]
+		}
+		return msg
+	}
+	return "src_open_err"
+}
+
+// countingReader tracks bytes read through it, so consumeInputSource can
+// checkpoint a source's absolute offset without the underlying io.Reader
+// needing to expose one itself (http response bodies don't).
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
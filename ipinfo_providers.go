@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// IPInfoProvider looks up ISP/country/IP-type info for the proxy currently
+// under test. client is pre-configured to dial through that proxy; providers
+// that answer locally instead of making an outbound call through it (e.g.
+// mmdbProvider) ignore it.
+type IPInfoProvider interface {
+	Name() string
+	Lookup(ctx context.Context, client *http.Client, proxyHost string) (IPInfo, error)
+}
+
+// httpJSONProvider is the shape shared by every HTTP-based IP-info API:
+// GET a JSON document through the proxy and hand the body to parse.
+type httpJSONProvider struct {
+	name  string
+	url   string
+	parse func(body []byte) (IPInfo, error)
+}
+
+func (p *httpJSONProvider) Name() string { return p.name }
+
+func (p *httpJSONProvider) Lookup(ctx context.Context, client *http.Client, _ string) (IPInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return IPInfo{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return IPInfo{}, fmt.Errorf("%s request failed: %v", p.name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return IPInfo{StatusCode: resp.StatusCode, Provider: p.name}, fmt.Errorf("%s status=%d", p.name, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 32*1024))
+	if err != nil {
+		return IPInfo{StatusCode: resp.StatusCode, Provider: p.name}, fmt.Errorf("%s read body failed: %v", p.name, err)
+	}
+
+	info, err := p.parse(body)
+	info.StatusCode = resp.StatusCode
+	info.Provider = p.name
+	return info, err
+}
+
+// parseFurryResp is the pre-existing sni-api.furry.ist response shape.
+func parseFurryResp(body []byte) (IPInfo, error) {
+	bodyStr := strings.TrimSpace(string(body))
+	if len(bodyStr) == 0 || bodyStr[0] != '{' {
+		return IPInfo{}, fmt.Errorf("invalid response: not JSON")
+	}
+
+	var data IPAPIResp
+	if err := json.Unmarshal(body, &data); err != nil {
+		return IPInfo{}, fmt.Errorf("json parse failed: %v", err)
+	}
+	if data.Code != 200 {
+		return IPInfo{}, fmt.Errorf("api error: code=%d", data.Code)
+	}
+
+	ipData := data.IPAPI
+	var info IPInfo
+	if ipData.Company.Name != "" {
+		info.ISP = strings.TrimSpace(ipData.Company.Name)
+	} else if ipData.ASN.Name != "" {
+		info.ISP = strings.TrimSpace(ipData.ASN.Name)
+	}
+	if ipData.ASN.Type != "" {
+		info.IPType = strings.TrimSpace(ipData.ASN.Type)
+	} else if ipData.Company.Type != "" {
+		info.IPType = strings.TrimSpace(ipData.Company.Type)
+	}
+	info.Country = strings.TrimSpace(ipData.Country)
+	info.IP = strings.TrimSpace(ipData.IP)
+	if info.Country == "" {
+		return info, fmt.Errorf("invalid response: missing country")
+	}
+	return info, nil
+}
+
+type ipinfoIOResp struct {
+	IP      string `json:"ip"`
+	Country string `json:"country"`
+	Org     string `json:"org"`
+}
+
+// parseIPInfoIO parses ipinfo.io/json, e.g. {"ip":"1.2.3.4","country":"US","org":"AS15169 Google LLC"}.
+func parseIPInfoIO(body []byte) (IPInfo, error) {
+	var r ipinfoIOResp
+	if err := json.Unmarshal(body, &r); err != nil {
+		return IPInfo{}, fmt.Errorf("json parse failed: %v", err)
+	}
+	if r.Country == "" {
+		return IPInfo{}, fmt.Errorf("invalid response: missing country")
+	}
+	return IPInfo{Country: r.Country, ISP: r.Org, IP: r.IP}, nil
+}
+
+type ipAPIComResp struct {
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+	Query       string `json:"query"`
+	CountryCode string `json:"countryCode"`
+	ISP         string `json:"isp"`
+	Org         string `json:"org"`
+}
+
+// parseIPAPICom parses ip-api.com/json, which reports failures via
+// "status":"fail" instead of an HTTP error status.
+func parseIPAPICom(body []byte) (IPInfo, error) {
+	var r ipAPIComResp
+	if err := json.Unmarshal(body, &r); err != nil {
+		return IPInfo{}, fmt.Errorf("json parse failed: %v", err)
+	}
+	if r.Status != "success" {
+		return IPInfo{}, fmt.Errorf("api error: %s", nonEmpty(r.Message, r.Status))
+	}
+	return IPInfo{Country: r.CountryCode, ISP: nonEmpty(r.ISP, r.Org), IP: r.Query}, nil
+}
+
+type ipwhoIsResp struct {
+	IP          string `json:"ip"`
+	Success     bool   `json:"success"`
+	Message     string `json:"message"`
+	CountryCode string `json:"country_code"`
+	Connection  struct {
+		ISP string `json:"isp"`
+		Org string `json:"org"`
+	} `json:"connection"`
+}
+
+// parseIPWhoIs parses ipwho.is, which also reports failures via a
+// "success":false body field rather than an HTTP error status.
+func parseIPWhoIs(body []byte) (IPInfo, error) {
+	var r ipwhoIsResp
+	if err := json.Unmarshal(body, &r); err != nil {
+		return IPInfo{}, fmt.Errorf("json parse failed: %v", err)
+	}
+	if !r.Success {
+		return IPInfo{}, fmt.Errorf("api error: %s", r.Message)
+	}
+	return IPInfo{Country: r.CountryCode, ISP: nonEmpty(r.Connection.ISP, r.Connection.Org), IP: r.IP}, nil
+}
+
+type ifconfigCoResp struct {
+	IP      string `json:"ip"`
+	Country string `json:"country_iso"`
+	ASNOrg  string `json:"asn_org"`
+}
+
+// parseIfconfigCo parses ifconfig.co/json, e.g.
+// {"ip":"1.2.3.4","country_iso":"US","asn_org":"GOOGLE"}.
+func parseIfconfigCo(body []byte) (IPInfo, error) {
+	var r ifconfigCoResp
+	if err := json.Unmarshal(body, &r); err != nil {
+		return IPInfo{}, fmt.Errorf("json parse failed: %v", err)
+	}
+	if r.IP == "" {
+		return IPInfo{}, fmt.Errorf("invalid response: missing ip")
+	}
+	return IPInfo{Country: r.Country, ISP: r.ASNOrg, IP: r.IP}, nil
+}
+
+// mmdbProvider answers IP-info lookups from a local MaxMind/IP2Location
+// database keyed on the proxy's own address, instead of making an outbound
+// request through it — the big win when checking large proxy lists, since
+// the per-proxy HTTPS round trip (and its rate limits) disappears entirely.
+type mmdbProvider struct {
+	db *maxminddb.Reader
+}
+
+func newMMDBProvider(path string) (*mmdbProvider, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open mmdb %s: %w", path, err)
+	}
+	return &mmdbProvider{db: db}, nil
+}
+
+func (p *mmdbProvider) Name() string { return "mmdb" }
+
+// mmdbRecord covers the fields GeoIP2/IP2Location City and ASN/ISP
+// databases commonly expose; fields an unknown database doesn't have just
+// come back zero.
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
+	ISP                          string `maxminddb:"isp"`
+}
+
+func (p *mmdbProvider) Lookup(_ context.Context, _ *http.Client, proxyHost string) (IPInfo, error) {
+	host, _, err := net.SplitHostPort(proxyHost)
+	if err != nil {
+		host = proxyHost
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return IPInfo{Provider: p.Name()}, fmt.Errorf("mmdb: resolve %s: %v", host, err)
+		}
+		ip = ips[0]
+	}
+
+	var rec mmdbRecord
+	if err := p.db.Lookup(ip, &rec); err != nil {
+		return IPInfo{Provider: p.Name()}, fmt.Errorf("mmdb lookup %s: %w", ip, err)
+	}
+	if rec.Country.ISOCode == "" {
+		return IPInfo{Provider: p.Name()}, fmt.Errorf("mmdb: no record for %s", ip)
+	}
+
+	return IPInfo{
+		Country:    rec.Country.ISOCode,
+		ISP:        nonEmpty(rec.ISP, rec.AutonomousSystemOrganization),
+		StatusCode: http.StatusOK,
+		Provider:   p.Name(),
+	}, nil
+}
+
+func (p *mmdbProvider) Close() error { return p.db.Close() }
+
+// ipInfoRegistry lists the providers buildIPInfoChain can select by name via
+// -ipinfo. "mmdb" isn't here because it needs -mmdb-path and is wired up
+// separately.
+var ipInfoRegistry = map[string]func() IPInfoProvider{
+	"furry": func() IPInfoProvider {
+		return &httpJSONProvider{name: "furry", url: primaryIPAPI, parse: parseFurryResp}
+	},
+	"ipinfo.io": func() IPInfoProvider {
+		return &httpJSONProvider{name: "ipinfo.io", url: "https://ipinfo.io/json", parse: parseIPInfoIO}
+	},
+	"ip-api.com": func() IPInfoProvider {
+		return &httpJSONProvider{name: "ip-api.com", url: "http://ip-api.com/json/", parse: parseIPAPICom}
+	},
+	"ipwho.is": func() IPInfoProvider {
+		return &httpJSONProvider{name: "ipwho.is", url: "https://ipwho.is/", parse: parseIPWhoIs}
+	},
+	"ifconfig.co": func() IPInfoProvider {
+		return &httpJSONProvider{name: "ifconfig.co", url: "https://ifconfig.co/json", parse: parseIfconfigCo}
+	},
+}
+
+// IPInfoChain tries providers in priority order, each bounded by its own
+// sub-timeout, and returns the first one that succeeds.
+type IPInfoChain struct {
+	providers []IPInfoProvider
+	timeout   time.Duration
+}
+
+func (c IPInfoChain) Fetch(ctx context.Context, client *http.Client, proxyHost string) (IPInfo, error) {
+	var lastErr error
+	for _, p := range c.providers {
+		pctx, cancel := context.WithTimeout(ctx, c.timeout)
+		info, err := p.Lookup(pctx, client, proxyHost)
+		cancel()
+		if err == nil {
+			return info, nil
+		}
+		lastErr = fmt.Errorf("%s: %w", p.Name(), err)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no ipinfo providers configured")
+	}
+	return IPInfo{}, lastErr
+}
+
+// buildIPInfoChain parses the comma-separated -ipinfo flag (provider names
+// in priority order) into an IPInfoChain. "mmdb" requires mmdbPath to point
+// at a MaxMind/IP2Location database file.
+func buildIPInfoChain(spec, mmdbPath string, timeout time.Duration) (IPInfoChain, error) {
+	chain := IPInfoChain{timeout: timeout}
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if name == "mmdb" {
+			if mmdbPath == "" {
+				return IPInfoChain{}, fmt.Errorf("-ipinfo includes \"mmdb\" but -mmdb-path is empty")
+			}
+			p, err := newMMDBProvider(mmdbPath)
+			if err != nil {
+				return IPInfoChain{}, err
+			}
+			chain.providers = append(chain.providers, p)
+			continue
+		}
+		factory, ok := ipInfoRegistry[name]
+		if !ok {
+			return IPInfoChain{}, fmt.Errorf("unknown ipinfo provider: %s", name)
+		}
+		chain.providers = append(chain.providers, factory())
+	}
+	if len(chain.providers) == 0 {
+		return IPInfoChain{}, fmt.Errorf("no ipinfo providers configured")
+	}
+	return chain, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ipVersionPref selects which IP family to prefer when dialing a proxy
+// whose host resolves to both A and AAAA records.
+type ipVersionPref string
+
+const (
+	ipVersionAuto     ipVersionPref = "auto"
+	ipVersionV4Only   ipVersionPref = "v4-only"
+	ipVersionV6Only   ipVersionPref = "v6-only"
+	ipVersionV4Prefer ipVersionPref = "v4-prefer"
+	ipVersionV6Prefer ipVersionPref = "v6-prefer"
+)
+
+func parseIPVersionPref(s string) ipVersionPref {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "v4-only", "v4", "4":
+		return ipVersionV4Only
+	case "v6-only", "v6", "6":
+		return ipVersionV6Only
+	case "v4-prefer":
+		return ipVersionV4Prefer
+	case "v6-prefer":
+		return ipVersionV6Prefer
+	default:
+		return ipVersionAuto
+	}
+}
+
+// stripIPVersionSuffix recognizes scheme suffixes like "socks5+v6" or
+// "http+v4-prefer" and returns the base scheme plus the requested
+// preference (ipVersionAuto if none was present).
+func stripIPVersionSuffix(scheme string) (string, ipVersionPref) {
+	i := strings.Index(scheme, "+")
+	if i < 0 {
+		return scheme, ipVersionAuto
+	}
+	base, suffix := scheme[:i], scheme[i+1:]
+	pref := parseIPVersionPref(suffix)
+	if pref == ipVersionAuto && suffix != "auto" {
+		// unrecognized suffix: don't silently eat part of the scheme
+		return scheme, ipVersionAuto
+	}
+	return base, pref
+}
+
+// happyEyeballsFallback is how long we wait for the preferred family to
+// connect before racing the rest of the address list, for *-prefer modes.
+const happyEyeballsFallback = 250 * time.Millisecond
+
+// dialWithIPPreference resolves addr's host (if it isn't already an IP
+// literal), filters/reorders the candidate addresses per pref, and dials
+// them via base. auto is a plain passthrough to base.DialContext, unless
+// resolver is non-nil (-resolver set): a custom resolver always needs to
+// run the lookup itself, so auto still goes through it, just without any
+// family reordering.
+func dialWithIPPreference(ctx context.Context, base *net.Dialer, network, addr string, pref ipVersionPref, resolver *HostResolver) (net.Conn, error) {
+	if resolver == nil && (pref == "" || pref == ipVersionAuto) {
+		return base.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return base.DialContext(ctx, network, addr)
+	}
+
+	var candidates []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		candidates = []net.IPAddr{{IP: ip}}
+	} else if resolver != nil {
+		ips, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		candidates = ips
+	} else {
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil || len(ips) == 0 {
+			return base.DialContext(ctx, network, addr)
+		}
+		candidates = ips
+	}
+
+	var v4, v6 []net.IPAddr
+	for _, ip := range candidates {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	var ordered []net.IPAddr
+	switch pref {
+	case ipVersionV4Only:
+		ordered = v4
+	case ipVersionV6Only:
+		ordered = v6
+	case ipVersionV4Prefer:
+		ordered = append(append([]net.IPAddr{}, v4...), v6...)
+	case ipVersionV6Prefer:
+		ordered = append(append([]net.IPAddr{}, v6...), v4...)
+	default:
+		ordered = candidates
+	}
+	if len(ordered) == 0 {
+		return nil, fmt.Errorf("no address of requested ip family for %s", host)
+	}
+
+	dialOne := func(ctx context.Context, ip net.IPAddr) (net.Conn, error) {
+		return base.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+	}
+
+	if (pref == ipVersionV4Prefer || pref == ipVersionV6Prefer) && len(ordered) > 1 {
+		return dialHappyEyeballsLite(ctx, ordered, dialOne)
+	}
+
+	var lastErr error
+	for _, ip := range ordered {
+		conn, err := dialOne(ctx, ip)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// ipPrefDialer adapts dialWithIPPreference to the proxy.Dialer interface
+// (Dial(network, addr) with no context) used by golang.org/x/net/proxy, for
+// callers like testSocks5Proxy that dial the SOCKS5 server itself through a
+// plain proxy.Dialer rather than a context-aware DialContext.
+type ipPrefDialer struct {
+	base     *net.Dialer
+	pref     ipVersionPref
+	timeout  time.Duration
+	resolver *HostResolver
+}
+
+func (d ipPrefDialer) Dial(network, addr string) (net.Conn, error) {
+	ctx := context.Background()
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+	return dialWithIPPreference(ctx, d.base, network, addr, d.pref, d.resolver)
+}
+
+// dialHappyEyeballsLite races the first (preferred-family) candidate, and
+// falls back to trying the rest sequentially if it doesn't win within
+// happyEyeballsFallback.
+func dialHappyEyeballsLite(ctx context.Context, ordered []net.IPAddr, dialOne func(context.Context, net.IPAddr) (net.Conn, error)) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	first := ordered[0]
+	resCh := make(chan dialResult, 1)
+	go func() {
+		c, err := dialOne(ctx, first)
+		resCh <- dialResult{c, err}
+	}()
+
+	select {
+	case r := <-resCh:
+		if r.err == nil {
+			return r.conn, nil
+		}
+	case <-time.After(happyEyeballsFallback):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	var lastErr error
+	for _, ip := range ordered[1:] {
+		conn, err := dialOne(ctx, ip)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	// the racer might still win after we've exhausted the rest
+	select {
+	case r := <-resCh:
+		if r.err == nil {
+			return r.conn, nil
+		}
+		if lastErr == nil {
+			lastErr = r.err
+		}
+	default:
+	}
+	return nil, lastErr
+}
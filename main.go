@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
@@ -27,6 +28,7 @@ import (
 	"time"
 
 	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
 )
 
 type Auth struct {
@@ -35,10 +37,11 @@ type Auth struct {
 }
 
 type Job struct {
-	ProxyAddr  string // host:port
-	SchemeHint string // "", "http", "https", "socks5"
-	InlineAuth *Auth  // 若输入行里带了 user:pass@，则优先用这个
-	RawLine    string // 仅用于 debug/统计
+	ProxyAddr  string        // host:port
+	SchemeHint string        // "", "http", "https", "socks5", "socks4", "socks4a"
+	IPVerHint  ipVersionPref // 若输入行里带了 +v4/+v6 等后缀，则覆盖全局 -ip-version
+	InlineAuth *Auth         // 若输入行里带了 user:pass@，则优先用这个
+	RawLine    string        // 仅用于 debug/统计
 }
 
 type Result struct {
@@ -49,9 +52,31 @@ type Result struct {
 	StatusCode int
 	Err        error
 
-	ISP     string
-	IPType  string
-	Country string
+	ISP      string
+	IPType   string
+	Country  string
+	Provider string
+
+	// TargetResults is the per-target reachability bitmap from -test-targets
+	// (empty when the flag isn't set), in the same order as the parsed
+	// target list.
+	TargetResults []TargetResult
+
+	// Bandwidth/latency facts for -out-format=json/csv; see AttemptStats.
+	BytesIn  uint64
+	BytesOut uint64
+	TLSMs    int64
+	TTFBMs   int64
+	TotalMs  int64
+
+	// TLS fingerprint of the handshake to the ipinfo target, captured for
+	// HTTPS/CONNECT proxies only (testHTTPSProxy); zero values elsewhere.
+	TLSVersion     string
+	TLSCipher      string
+	ALPN           string
+	CertCN         string
+	CertIssuer     string
+	CertSelfSigned bool
 }
 
 const (
@@ -134,7 +159,12 @@ type IPInfo struct {
 	IPType     string
 	Country    string
 	StatusCode int
-	Source     string
+	Provider   string
+
+	// IP is the exit IP the provider reports back (when the API exposes
+	// one); used by QuorumProber to detect a proxy injecting fake ipinfo
+	// responses for an IP that isn't actually its egress address.
+	IP string
 }
 
 // ========== HTTP/HTTPS 代理拨号器 ==========
@@ -143,6 +173,8 @@ type HTTPProxyDialer struct {
 	auth     *Auth
 	useTLS   bool
 	timeout  time.Duration
+	ipPref   ipVersionPref
+	resolver *HostResolver
 	baseDial func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
@@ -153,7 +185,7 @@ func newDialer(timeout time.Duration) *net.Dialer {
 		Control: func(network, address string, c syscall.RawConn) error {
 			var ctlErr error
 			_ = c.Control(func(fd uintptr) {
-				ctlErr = setSockLinger(fd)
+				ctlErr = Tune(fd, defaultTuneOptions())
 			})
 			return ctlErr
 		},
@@ -171,7 +203,7 @@ func (d *HTTPProxyDialer) DialContext(ctx context.Context, network, addr string)
 		if dl, ok := ctx.Deadline(); ok {
 			nd.Deadline = dl
 		}
-		conn, err = nd.DialContext(ctx, "tcp", d.addr)
+		conn, err = dialWithIPPreference(ctx, nd, "tcp", d.addr, d.ipPref, d.resolver)
 	}
 	if err != nil {
 		return nil, err
@@ -250,9 +282,15 @@ func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
 type countingRoundTripper struct {
 	base    http.RoundTripper
 	counter *uint64
+	limiter *rate.Limiter
 }
 
 func (c countingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.limiter != nil {
+		if err := c.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
 	if c.counter != nil {
 		atomic.AddUint64(c.counter, 1)
 	}
@@ -312,7 +350,10 @@ type CDNFilter struct {
 	V6 []cidrEntry
 }
 
-func (f *CDNFilter) Match(ip net.IP) (string, bool) {
+// MatchWithProvider reports whether ip falls in a known CDN/anycast range,
+// and if so which provider's range matched — callers feed the provider
+// name into their own skip-reason stats (e.g. "cdn_cloudflare").
+func (f *CDNFilter) MatchWithProvider(ip net.IP) (string, bool) {
 	if ip == nil {
 		return "", false
 	}
@@ -332,6 +373,45 @@ func (f *CDNFilter) Match(ip net.IP) (string, bool) {
 	return "", false
 }
 
+// allowed reports whether provider should be fetched/kept, given the
+// -cdn-allow allowlist (nil/empty allow means "keep everything").
+func allowed(allow map[string]bool, provider string) bool {
+	return len(allow) == 0 || allow[provider]
+}
+
+// parseCDNAllowList parses the comma-separated -cdn-allow flag.
+func parseCDNAllowList(s string) map[string]bool {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" {
+			m[p] = true
+		}
+	}
+	return m
+}
+
+// parseCDNExtraSources parses the comma-separated "name=url,..." -cdn-extra flag.
+func parseCDNExtraSources(s string) map[string]string {
+	m := make(map[string]string)
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			continue
+		}
+		m[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return m
+}
+
 func (f *CDNFilter) addCIDR(provider, cidr string) {
 	_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
 	if err != nil || n == nil {
@@ -366,12 +446,79 @@ func fetchTextFields(ctx context.Context, client *http.Client, u string) ([]stri
 	return strings.Fields(string(b)), nil
 }
 
-func loadCDNFilter(ctx context.Context) (*CDNFilter, error) {
+// cdnCacheEntry/cdnCacheFile are the on-disk shape of -cdn-cache: a flat,
+// provider-tagged CIDR list plus a fetch timestamp used for the -cdn-cache-ttl
+// freshness check.
+type cdnCacheEntry struct {
+	Provider string `json:"provider"`
+	CIDR     string `json:"cidr"`
+}
+
+type cdnCacheFile struct {
+	FetchedAt time.Time       `json:"fetched_at"`
+	Entries   []cdnCacheEntry `json:"entries"`
+}
+
+func saveCDNCache(path string, f *CDNFilter) error {
+	cf := cdnCacheFile{FetchedAt: time.Now()}
+	for _, e := range f.V4 {
+		cf.Entries = append(cf.Entries, cdnCacheEntry{Provider: e.Provider, CIDR: e.Net.String()})
+	}
+	for _, e := range f.V6 {
+		cf.Entries = append(cf.Entries, cdnCacheEntry{Provider: e.Provider, CIDR: e.Net.String()})
+	}
+	b, err := json.MarshalIndent(cf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+// loadCDNCacheIfFresh returns a CDNFilter rebuilt from cachePath if it
+// exists and is younger than ttl, so a run can stay fully offline.
+func loadCDNCacheIfFresh(cachePath string, ttl time.Duration) (*CDNFilter, error) {
+	if cachePath == "" || ttl <= 0 {
+		return nil, fmt.Errorf("cdn cache disabled")
+	}
+	b, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	var cf cdnCacheFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return nil, err
+	}
+	if age := time.Since(cf.FetchedAt); age > ttl {
+		return nil, fmt.Errorf("cdn cache stale (age=%s)", age)
+	}
+	f := &CDNFilter{}
+	for _, e := range cf.Entries {
+		f.addCIDR(e.Provider, e.CIDR)
+	}
+	if len(f.V4) == 0 && len(f.V6) == 0 {
+		return nil, fmt.Errorf("cdn cache empty")
+	}
+	return f, nil
+}
+
+// loadCDNFilter builds the CDN/anycast CIDR filter. It first tries the
+// local cache (cachePath, good for cacheTTL), and only hits the network on
+// a cache miss/expiry. allow (nil/empty = everything) restricts which
+// providers are fetched and kept. extra is a provider-name -> URL map for
+// sources with no one stable canonical endpoint to hardcode (Akamai
+// doesn't publish official ranges at all, and Azure's service-tags file
+// sits behind a rotating weekly download link) — each extra URL is expected
+// to return a plain newline-separated CIDR list, same shape as Cloudflare's.
+func loadCDNFilter(ctx context.Context, cachePath string, cacheTTL time.Duration, allow map[string]bool, extra map[string]string) (*CDNFilter, error) {
+	if f, err := loadCDNCacheIfFresh(cachePath, cacheTTL); err == nil {
+		return f, nil
+	}
+
 	client := &http.Client{Timeout: 12 * time.Second}
 	f := &CDNFilter{}
 
 	// Cloudflare
-	{
+	if allowed(allow, "cloudflare") {
 		fields, err := fetchTextFields(ctx, client, "https://www.cloudflare.com/ips-v4")
 		if err == nil {
 			for _, s := range fields {
@@ -387,7 +534,7 @@ func loadCDNFilter(ctx context.Context) (*CDNFilter, error) {
 	}
 
 	// Fastly
-	{
+	if allowed(allow, "fastly") {
 		type fastlyResp struct {
 			Addresses     []string `json:"addresses"`
 			IPv6Addresses []string `json:"ipv6_addresses"`
@@ -420,7 +567,7 @@ func loadCDNFilter(ctx context.Context) (*CDNFilter, error) {
 	}
 
 	// AWS CloudFront
-	{
+	if allowed(allow, "cloudfront") {
 		type awsRanges struct {
 			Prefixes []struct {
 				IPPrefix string `json:"ip_prefix"`
@@ -464,9 +611,110 @@ func loadCDNFilter(ctx context.Context) (*CDNFilter, error) {
 		}
 	}
 
+	// Google (Cloud + general goog.json, both published as a flat prefix list)
+	if allowed(allow, "google") {
+		type googleRanges struct {
+			Prefixes []struct {
+				IPv4Prefix string `json:"ipv4Prefix"`
+				IPv6Prefix string `json:"ipv6Prefix"`
+			} `json:"prefixes"`
+		}
+		for _, u := range []string{"https://www.gstatic.com/ipranges/cloud.json", "https://www.gstatic.com/ipranges/goog.json"} {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				continue
+			}
+			req.Header.Set("User-Agent", userAgent)
+			resp, err := client.Do(req)
+			if err != nil {
+				continue
+			}
+			func() {
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					_, _ = io.Copy(io.Discard, resp.Body)
+					return
+				}
+				var gr googleRanges
+				dec := json.NewDecoder(io.LimitReader(resp.Body, 16<<20))
+				if err := dec.Decode(&gr); err != nil {
+					return
+				}
+				for _, p := range gr.Prefixes {
+					if p.IPv4Prefix != "" {
+						f.addCIDR("google", p.IPv4Prefix)
+					}
+					if p.IPv6Prefix != "" {
+						f.addCIDR("google", p.IPv6Prefix)
+					}
+				}
+			}()
+		}
+	}
+
+	// GitHub Meta
+	if allowed(allow, "github") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.github.com/meta", nil)
+		if err == nil {
+			req.Header.Set("User-Agent", userAgent)
+			req.Header.Set("Accept", "application/vnd.github+json")
+			resp, err := client.Do(req)
+			if err == nil {
+				func() {
+					defer resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						_, _ = io.Copy(io.Discard, resp.Body)
+						return
+					}
+					var meta map[string]json.RawMessage
+					dec := json.NewDecoder(io.LimitReader(resp.Body, 4<<20))
+					if err := dec.Decode(&meta); err != nil {
+						return
+					}
+					// only the documented network-range keys; fields like
+					// "ssh_key_fingerprints"/"domains" aren't CIDR lists.
+					for _, key := range []string{"hooks", "web", "api", "git", "packages", "pages", "importer", "actions", "dependabot"} {
+						raw, ok := meta[key]
+						if !ok {
+							continue
+						}
+						var cidrs []string
+						if err := json.Unmarshal(raw, &cidrs); err != nil {
+							continue
+						}
+						for _, c := range cidrs {
+							f.addCIDR("github", c)
+						}
+					}
+				}()
+			}
+		}
+	}
+
+	// Extra opt-in sources (Akamai/Azure/Bunny/DigitalOcean/...), see doc comment above.
+	for name, u := range extra {
+		if !allowed(allow, name) {
+			continue
+		}
+		fields, err := fetchTextFields(ctx, client, u)
+		if err != nil {
+			continue
+		}
+		for _, s := range fields {
+			f.addCIDR(name, s)
+		}
+	}
+
 	if len(f.V4) == 0 && len(f.V6) == 0 {
 		return nil, fmt.Errorf("cdn cidr empty (all sources failed?)")
 	}
+
+	if cachePath != "" {
+		if err := saveCDNCache(cachePath, f); err != nil {
+			log.Printf("CDN 缓存写入失败(%s): %v", cachePath, err)
+		}
+	}
+
 	return f, nil
 }
 
@@ -534,10 +782,10 @@ func formatTopStats(cm *CounterMap, topN int) string {
 }
 
 // ========== 输入解析 ==========
-func parseProxyLine(line, defaultPort string) (addr string, schemeHint string, inlineAuth *Auth, err error) {
+func parseProxyLine(line, defaultPort string) (addr string, schemeHint string, ipVerHint ipVersionPref, inlineAuth *Auth, err error) {
 	line = strings.TrimSpace(line)
 	if line == "" {
-		return "", "", nil, fmt.Errorf("empty line")
+		return "", "", "", nil, fmt.Errorf("empty line")
 	}
 
 	defaultPortForScheme := func(scheme string) string {
@@ -546,7 +794,7 @@ func parseProxyLine(line, defaultPort string) (addr string, schemeHint string, i
 			return "80"
 		case "https":
 			return "443"
-		case "socks5", "s5":
+		case "socks5", "s5", "socks4", "socks4a":
 			return "1080"
 		default:
 			return ""
@@ -558,17 +806,18 @@ func parseProxyLine(line, defaultPort string) (addr string, schemeHint string, i
 		if e == nil && u != nil && u.Host != "" {
 			host := u.Hostname()
 			port := u.Port()
+			baseScheme, ipVer := stripIPVersionSuffix(strings.ToLower(strings.TrimSpace(u.Scheme)))
 			if port == "" {
 				if defaultPort == "" {
-					defaultPort = defaultPortForScheme(u.Scheme)
+					defaultPort = defaultPortForScheme(baseScheme)
 				}
 				if defaultPort == "" {
-					return "", "", nil, fmt.Errorf("missing port in %q; use -p", line)
+					return "", "", "", nil, fmt.Errorf("missing port in %q; use -p", line)
 				}
 				port = defaultPort
 			}
 			hostport := net.JoinHostPort(host, port)
-			schemeHint = strings.ToLower(strings.TrimSpace(u.Scheme))
+			schemeHint = baseScheme
 			if u.User != nil {
 				user := u.User.Username()
 				pass, _ := u.User.Password()
@@ -576,7 +825,7 @@ func parseProxyLine(line, defaultPort string) (addr string, schemeHint string, i
 					inlineAuth = &Auth{User: user, Pass: pass}
 				}
 			}
-			return hostport, schemeHint, inlineAuth, nil
+			return hostport, schemeHint, ipVer, inlineAuth, nil
 		}
 	}
 
@@ -587,7 +836,7 @@ func parseProxyLine(line, defaultPort string) (addr string, schemeHint string, i
 			port := u.Port()
 			if port == "" {
 				if defaultPort == "" {
-					return "", "", nil, fmt.Errorf("missing port in %q; use -p", line)
+					return "", "", "", nil, fmt.Errorf("missing port in %q; use -p", line)
 				}
 				port = defaultPort
 			}
@@ -599,56 +848,62 @@ func parseProxyLine(line, defaultPort string) (addr string, schemeHint string, i
 					inlineAuth = &Auth{User: user, Pass: pass}
 				}
 			}
-			return hostport, "", inlineAuth, nil
+			return hostport, "", "", inlineAuth, nil
 		}
 	}
 
 	if ip := net.ParseIP(line); ip != nil {
 		if defaultPort == "" {
-			return "", "", nil, fmt.Errorf("pure ip %s missing port; use -p", line)
+			return "", "", "", nil, fmt.Errorf("pure ip %s missing port; use -p", line)
 		}
 		if strings.Contains(line, ":") {
-			return "[" + line + "]:" + defaultPort, "", nil, nil
+			return "[" + line + "]:" + defaultPort, "", "", nil, nil
 		}
-		return line + ":" + defaultPort, "", nil, nil
+		return line + ":" + defaultPort, "", "", nil, nil
 	}
 
 	if strings.Contains(line, ":") {
 		if host, port, e := net.SplitHostPort(line); e == nil {
-			return net.JoinHostPort(host, port), "", nil, nil
+			return net.JoinHostPort(host, port), "", "", nil, nil
 		}
 		if ip := net.ParseIP(strings.Trim(line, "[]")); ip != nil {
 			if defaultPort == "" {
-				return "", "", nil, fmt.Errorf("missing port in %q; use -p", line)
+				return "", "", "", nil, fmt.Errorf("missing port in %q; use -p", line)
 			}
-			return net.JoinHostPort(ip.String(), defaultPort), "", nil, nil
+			return net.JoinHostPort(ip.String(), defaultPort), "", "", nil, nil
 		}
 		if defaultPort != "" {
-			return net.JoinHostPort(line, defaultPort), "", nil, nil
+			return net.JoinHostPort(line, defaultPort), "", "", nil, nil
 		}
-		return "", "", nil, fmt.Errorf("missing port in %q; use -p", line)
+		return "", "", "", nil, fmt.Errorf("missing port in %q; use -p", line)
 	}
 
 	if defaultPort == "" {
-		return "", "", nil, fmt.Errorf("host %s missing port; use -p", line)
+		return "", "", "", nil, fmt.Errorf("host %s missing port; use -p", line)
 	}
-	return net.JoinHostPort(line, defaultPort), "", nil, nil
+	return net.JoinHostPort(line, defaultPort), "", "", nil, nil
 }
 
+// socks4AutoFallback is appended after socks5 in every guessProxyOrder(WithScheme)
+// result: "auto"/"all" always gives plain SOCKS4 a try once SOCKS5 has been
+// ruled out, but never guesses SOCKS4a (it needs a scheme hint, since a
+// bare host:port gives no signal that the far end wants a hostname).
+const socks4AutoFallback = "socks4"
+
 func guessProxyOrder(addr string) []string {
 	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return []string{"https", "http", "socks5"}
+		return []string{"https", "http", "socks5", socks4AutoFallback}
 	}
 	switch port {
 	case "443", "8443", "9443":
-		return []string{"https", "http", "socks5"}
+		return []string{"https", "http", "socks5", socks4AutoFallback}
 	case "80", "8080", "3128", "8000", "8888":
-		return []string{"http", "https", "socks5"}
+		return []string{"http", "https", "socks5", socks4AutoFallback}
 	case "1080":
-		return []string{"socks5", "http", "https"}
+		return []string{"socks5", socks4AutoFallback, "http", "https"}
 	default:
-		return []string{"https", "http", "socks5"}
+		return []string{"https", "http", "socks5", socks4AutoFallback}
 	}
 }
 
@@ -656,11 +911,15 @@ func guessProxyOrderWithScheme(addr, scheme string) []string {
 	scheme = strings.ToLower(strings.TrimSpace(scheme))
 	switch scheme {
 	case "http":
-		return []string{"http", "https", "socks5"}
+		return []string{"http", "https", "socks5", socks4AutoFallback}
 	case "https":
-		return []string{"https", "http", "socks5"}
+		return []string{"https", "http", "socks5", socks4AutoFallback}
 	case "socks5", "s5":
-		return []string{"socks5", "http", "https"}
+		return []string{"socks5", socks4AutoFallback, "http", "https"}
+	case "socks4":
+		return []string{"socks4"}
+	case "socks4a":
+		return []string{"socks4a"}
 	default:
 		return guessProxyOrder(addr)
 	}
@@ -745,112 +1004,126 @@ func loadAuthsOptional(path string) ([]Auth, error) {
 }
 
 // ========== 上游 dialer（可选） ==========
-func buildUpstreamDialer(mode, addr string, auth Auth, timeout time.Duration) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
-	if addr == "" {
-		return nil, nil
+
+// upstreamHop is one leg of a (possibly chained) -upstream spec.
+type upstreamHop struct {
+	mode string
+	addr string
+	auth Auth
+}
+
+// parseUpstreamChain splits a comma-separated -upstream spec such as
+// "socks5://user:pass@a:1080,https://b:443,http://c:8080" into hops in
+// dial order. A hop with no "scheme://" prefix falls back to
+// defaultMode/defaultAuth, so the plain single-hop "-upstream host:port
+// -upstream-mode s5 -upstream-auth user:pass" form keeps working unchanged.
+func parseUpstreamChain(spec, defaultMode string, defaultAuth Auth) ([]upstreamHop, error) {
+	var hops []upstreamHop
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mode, a, addr := defaultMode, Auth{}, part
+		if idx := strings.Index(part, "://"); idx >= 0 {
+			mode = strings.ToLower(part[:idx])
+			addr = part[idx+3:]
+			if at := strings.LastIndex(addr, "@"); at >= 0 {
+				if cp := strings.SplitN(addr[:at], ":", 2); len(cp) == 2 {
+					a.User, a.Pass = cp[0], cp[1]
+				}
+				addr = addr[at+1:]
+			}
+		} else if len(hops) == 0 {
+			a = defaultAuth
+		}
+		switch mode {
+		case "s5", "socks5", "http", "https":
+		default:
+			return nil, fmt.Errorf("unsupported upstream mode in chain: %s", mode)
+		}
+		hops = append(hops, upstreamHop{mode: mode, addr: addr, auth: a})
 	}
-	mode = strings.ToLower(mode)
-	switch mode {
+	if len(hops) == 0 {
+		return nil, fmt.Errorf("empty upstream chain")
+	}
+	return hops, nil
+}
+
+// buildHopDialer builds the dialer for a single chain hop. base is the
+// previous hop's dialer (nil for the first hop, which dials directly).
+func buildHopDialer(hop upstreamHop, timeout time.Duration, ipPref ipVersionPref,
+	base func(ctx context.Context, network, addr string) (net.Conn, error)) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+
+	switch hop.mode {
 	case "s5", "socks5":
 		var sAuth *proxy.Auth
-		if auth.User != "" || auth.Pass != "" {
-			sAuth = &proxy.Auth{User: auth.User, Password: auth.Pass}
+		if hop.auth.User != "" || hop.auth.Pass != "" {
+			sAuth = &proxy.Auth{User: hop.auth.User, Password: hop.auth.Pass}
+		}
+		var forward proxy.Dialer
+		if base != nil {
+			forward = contextDialer{DialContext: base}
+		} else {
+			forward = ipPrefDialer{base: newDialer(timeout), pref: ipPref, timeout: timeout}
 		}
-		base := newDialer(timeout)
-		d, err := proxy.SOCKS5("tcp", addr, sAuth, base)
+		d, err := proxy.SOCKS5("tcp", hop.addr, sAuth, forward)
 		if err != nil {
 			return nil, err
 		}
 		return func(ctx context.Context, network, target string) (net.Conn, error) { return d.Dial(network, target) }, nil
 	case "http", "https":
 		var a *Auth
-		if auth.User != "" || auth.Pass != "" {
-			a = &auth
+		if hop.auth.User != "" || hop.auth.Pass != "" {
+			a = &hop.auth
 		}
-		httpDialer := &HTTPProxyDialer{addr: addr, auth: a, useTLS: mode == "https", timeout: timeout}
+		httpDialer := &HTTPProxyDialer{addr: hop.addr, auth: a, useTLS: hop.mode == "https", timeout: timeout, ipPref: ipPref, baseDial: base}
 		return httpDialer.DialContext, nil
 	default:
-		return nil, fmt.Errorf("unsupported upstream mode: %s", mode)
+		return nil, fmt.Errorf("unsupported upstream mode: %s", hop.mode)
 	}
 }
 
-// ========== 拉 IP 信息 ==========
-func fetchIPInfoWithClient(ctx context.Context, client *http.Client) (IPInfo, error) {
-	var info IPInfo
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, primaryIPAPI, nil)
-	if err != nil {
-		return info, err
+// buildUpstreamDialer turns -upstream/-upstream-mode/-upstream-auth into a
+// single DialContext func. addr may be a comma-separated chain (e.g.
+// "socks5://user:pass@a:1080,https://b:443"); each hop tunnels through the
+// previous one, so the returned func connects through the whole chain in
+// order. hopFail (optional) is incremented as "upstream_hopN_<reason>"
+// when a hop fails, so chain problems can be attributed to the hop that
+// actually broke instead of just "upstream failed".
+func buildUpstreamDialer(mode, addr string, auth Auth, timeout time.Duration, ipPref ipVersionPref, hopFail *CounterMap) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if addr == "" {
+		return nil, nil
 	}
-
-	// 模拟 Chrome 浏览器的请求头
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Accept-Language", "zh-CN,zh;q=0.9")
-	req.Header.Set("User-Agent", userAgent)
-
-	resp, err := client.Do(req)
+	hops, err := parseUpstreamChain(addr, strings.ToLower(mode), auth)
 	if err != nil {
-		return info, fmt.Errorf("ipinfo request failed: %v", err)
-	}
-	defer resp.Body.Close()
-
-	info.StatusCode = resp.StatusCode
-	if resp.StatusCode != http.StatusOK {
-		_, _ = io.Copy(io.Discard, resp.Body)
-		return info, fmt.Errorf("ipinfo status=%d", resp.StatusCode)
-	}
-
-	// 限制读取大小为32KB
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 32*1024))
-	if err != nil {
-		return info, fmt.Errorf("ipinfo read body failed: %v", err)
-	}
-
-	// 检查响应是否像有效的JSON（简单检查开头是否为 { ）
-	bodyStr := strings.TrimSpace(string(body))
-	if len(bodyStr) == 0 || bodyStr[0] != '{' {
-		return info, fmt.Errorf("ipinfo invalid response: not JSON")
-	}
-
-	var data IPAPIResp
-	if err := json.Unmarshal(body, &data); err != nil {
-		return info, fmt.Errorf("ipinfo json parse failed: %v", err)
-	}
-
-	// 检查 API 返回码
-	if data.Code != 200 {
-		return info, fmt.Errorf("ipinfo api error: code=%d", data.Code)
-	}
-
-	// 提取有用信息
-	ipData := data.IPAPI
-
-	// ISP: 优先使用 Company.Name, 其次使用 ASN.Name
-	if ipData.Company.Name != "" {
-		info.ISP = strings.TrimSpace(ipData.Company.Name)
-	} else if ipData.ASN.Name != "" {
-		info.ISP = strings.TrimSpace(ipData.ASN.Name)
-	}
-
-	// IPType: 使用 ASN.Type 或 Company.Type
-	if ipData.ASN.Type != "" {
-		info.IPType = strings.TrimSpace(ipData.ASN.Type)
-	} else if ipData.Company.Type != "" {
-		info.IPType = strings.TrimSpace(ipData.Company.Type)
+		return nil, err
 	}
 
-	// Country: 使用国家代码
-	info.Country = strings.TrimSpace(ipData.Country)
-	info.Source = "sni-api.furry.ist"
-
-	// 验证是否获取到有效数据：至少有一个字段非空且 Country 非空才算成功
-	if ipData.Country == "" {
-		return info, fmt.Errorf("ipinfo invalid response: missing country")
+	var dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	for i, hop := range hops {
+		hopDial, err := buildHopDialer(hop, timeout, ipPref, dial)
+		if err != nil {
+			return nil, fmt.Errorf("upstream hop %d (%s): %w", i+1, hop.addr, err)
+		}
+		hopNum := i + 1
+		dial = func(ctx context.Context, network, target string) (net.Conn, error) {
+			conn, err := hopDial(ctx, network, target)
+			if err != nil {
+				hopFail.Inc(fmt.Sprintf("upstream_hop%d_%s", hopNum, classifyErr(err)))
+				return nil, fmt.Errorf("hop %d: %w", hopNum, err)
+			}
+			return conn, nil
+		}
 	}
-
-	return info, nil
+	return dial, nil
 }
 
+// ========== 拉 IP 信息 ==========
+// fetchIPInfoWithClient and the primaryIPAPI-only lookup logic moved into
+// the pluggable IPInfoProvider chain in ipinfo_providers.go (see
+// parseFurryResp for the sni-api.furry.ist shape preserved as-is).
+
 // ========== 错误分类 ==========
 func isTimeoutErr(err error) bool {
 	if err == nil {
@@ -895,7 +1168,13 @@ func classifyErr(err error) string {
 	if err == nil {
 		return ""
 	}
+	if errors.Is(err, errBreakerOpen) {
+		return "breaker_open"
+	}
 	msg := strings.ToLower(err.Error())
+	if strings.Contains(msg, "hijacked") {
+		return "hijacked"
+	}
 	if isHTTPSClientGotHTTP(err) {
 		return "https_to_http"
 	}
@@ -920,6 +1199,9 @@ func classifyErr(err error) string {
 	if isTimeoutErr(err) {
 		return "timeout"
 	}
+	if strings.Contains(msg, "alpn") {
+		return "alpn"
+	}
 	if strings.Contains(msg, "tls") || strings.Contains(msg, "handshake") {
 		return "tls"
 	}
@@ -969,7 +1251,7 @@ func isLikelyPlainHTTPProxy(err error) bool {
 // ========== 具体测试 ==========
 func testHTTPProxy(ctx context.Context, proxyAddr string, a Auth, timeout time.Duration,
 	upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error),
-	reqCounter *uint64) (IPInfo, int, error) {
+	reqCounter *uint64, ipPref ipVersionPref, ipChain IPInfoChain, targets []TestTarget, limiter *rate.Limiter, probeEngine string, quorum *QuorumProber, resolver *HostResolver) (IPInfo, int, []TargetResult, AttemptStats, error) {
 
 	proxyURL := &url.URL{Scheme: "http", Host: proxyAddr}
 	if a.User != "" || a.Pass != "" {
@@ -983,6 +1265,8 @@ func testHTTPProxy(ctx context.Context, proxyAddr string, a Auth, timeout time.D
 	tracker := newConnTracker()
 	defer tracker.closeAll()
 
+	timing := newConnTiming()
+
 	baseDialer := newDialer(timeout / 2)
 
 	tr := &http.Transport{
@@ -993,12 +1277,12 @@ func testHTTPProxy(ctx context.Context, proxyAddr string, a Auth, timeout time.D
 			if upstreamDial != nil {
 				conn, err = upstreamDial(ctx, network, addr)
 			} else {
-				conn, err = baseDialer.DialContext(ctx, network, addr)
+				conn, err = dialWithIPPreference(ctx, baseDialer, network, addr, ipPref, resolver)
 			}
 			if err != nil {
 				return nil, err
 			}
-			return tracker.track(conn), nil
+			return tracker.track(&countingConn{Conn: conn, timing: timing}), nil
 		},
 		TLSClientConfig:        &tls.Config{InsecureSkipVerify: true},
 		DisableKeepAlives:      true,
@@ -1023,17 +1307,30 @@ func testHTTPProxy(ctx context.Context, proxyAddr string, a Auth, timeout time.D
 		tr.ProxyConnectHeader = h
 	}
 
-	rt := countingRoundTripper{base: tr, counter: reqCounter}
+	rt := countingRoundTripper{base: tr, counter: reqCounter, limiter: limiter}
 	client := &http.Client{Transport: rt, Timeout: timeout}
 
-	info, err := fetchIPInfoWithClient(ctx, client)
+	var info IPInfo
+	var err error
+	switch {
+	case quorum != nil:
+		info, err = quorum.Fetch(timing.withTrace(ctx), client, proxyAddr)
+	case probeEngine == probeEngineFastHTTP:
+		info, err = fetchIPInfoFast(ctx, ipChain, fastDialPlainHTTP(ctx, proxyAddr, upstreamDial, ipPref, timeout, resolver), timeout, proxyAddr, reqCounter)
+	default:
+		info, err = ipChain.Fetch(timing.withTrace(ctx), client, proxyAddr)
+	}
+	var targetResults []TargetResult
+	if err == nil && len(targets) > 0 {
+		targetResults = checkTestTargets(ctx, client, tr.DialContext, timeout, targets)
+	}
 	tr.CloseIdleConnections()
-	return info, info.StatusCode, err
+	return info, info.StatusCode, targetResults, timing.snapshot(), err
 }
 
 func testHTTPSProxy(ctx context.Context, proxyAddr string, a Auth, timeout time.Duration,
 	upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error),
-	reqCounter *uint64) (IPInfo, int, error) {
+	reqCounter *uint64, ipPref ipVersionPref, ipChain IPInfoChain, targets []TestTarget, limiter *rate.Limiter, probeEngine string, tlsPolicy TLSPolicy, quorum *QuorumProber, resolver *HostResolver) (IPInfo, int, []TargetResult, AttemptStats, TLSFingerprint, error) {
 
 	var cred *Auth
 	if a.User != "" || a.Pass != "" {
@@ -1047,6 +1344,9 @@ func testHTTPSProxy(ctx context.Context, proxyAddr string, a Auth, timeout time.
 	tracker := newConnTracker()
 	defer tracker.closeAll()
 
+	timing := newConnTiming()
+	tlsCap := newTLSCapture()
+
 	hpd := &HTTPProxyDialer{
 		addr:    proxyAddr,
 		auth:    cred,
@@ -1062,18 +1362,18 @@ func testHTTPSProxy(ctx context.Context, proxyAddr string, a Auth, timeout time.
 				if dl, ok := ctx.Deadline(); ok {
 					d.Deadline = dl
 				}
-				conn, err = d.DialContext(ctx, network, addr)
+				conn, err = dialWithIPPreference(ctx, d, network, addr, ipPref, resolver)
 			}
 			if err != nil {
 				return nil, err
 			}
-			return tracker.track(conn), nil
+			return tracker.track(&countingConn{Conn: conn, timing: timing}), nil
 		},
 	}
 
 	tr := &http.Transport{
 		DialContext:            hpd.DialContext,
-		TLSClientConfig:        &tls.Config{InsecureSkipVerify: true},
+		TLSClientConfig:        &tls.Config{InsecureSkipVerify: true, MinVersion: tlsPolicy.MinVersion},
 		DisableKeepAlives:      true,
 		MaxIdleConns:           1,
 		MaxIdleConnsPerHost:    1,
@@ -1089,23 +1389,43 @@ func testHTTPSProxy(ctx context.Context, proxyAddr string, a Auth, timeout time.
 		ReadBufferSize:         4 * 1024,
 	}
 
-	rt := countingRoundTripper{base: tr, counter: reqCounter}
+	rt := countingRoundTripper{base: tr, counter: reqCounter, limiter: limiter}
 	client := &http.Client{Transport: rt, Timeout: timeout}
 
-	info, err := fetchIPInfoWithClient(ctx, client)
+	var info IPInfo
+	var err error
+	switch {
+	case quorum != nil:
+		info, err = quorum.Fetch(tlsCap.withTrace(timing.withTrace(ctx)), client, proxyAddr)
+	case probeEngine == probeEngineFastHTTP:
+		info, err = fetchIPInfoFast(ctx, ipChain, fastDialHTTPSProxy(ctx, hpd), timeout, proxyAddr, reqCounter)
+	default:
+		info, err = ipChain.Fetch(tlsCap.withTrace(timing.withTrace(ctx)), client, proxyAddr)
+	}
+	var targetResults []TargetResult
+	if err == nil && len(targets) > 0 {
+		targetResults = checkTestTargets(ctx, client, hpd.DialContext, timeout, targets)
+	}
 	tr.CloseIdleConnections()
+
+	fp := tlsCap.fingerprint()
+	if err == nil && !alpnAllowed(fp.ALPN, tlsPolicy.RequireALPN) {
+		err = fmt.Errorf("alpn %q not in -require-alpn allowlist %v", nonEmpty(fp.ALPN, "(none)"), tlsPolicy.RequireALPN)
+	}
+
 	if err != nil && isLikelyPlainHTTPProxy(err) {
 		// 回退到HTTP代理测试时，创建新的带超时的context
 		newCtx, newCancel := context.WithTimeout(context.Background(), timeout)
 		defer newCancel()
-		return testHTTPProxy(newCtx, proxyAddr, a, timeout, upstreamDial, reqCounter)
+		info, status, targetResults, stats, err := testHTTPProxy(newCtx, proxyAddr, a, timeout, upstreamDial, reqCounter, ipPref, ipChain, targets, limiter, probeEngine, quorum, resolver)
+		return info, status, targetResults, stats, TLSFingerprint{}, err
 	}
-	return info, info.StatusCode, err
+	return info, info.StatusCode, targetResults, timing.snapshot(), fp, err
 }
 
 func testSocks5Proxy(ctx context.Context, proxyAddr string, a Auth, timeout time.Duration,
 	upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error),
-	reqCounter *uint64) (IPInfo, int, error) {
+	reqCounter *uint64, ipPref ipVersionPref, ipChain IPInfoChain, targets []TestTarget, limiter *rate.Limiter, probeEngine string, quorum *QuorumProber, resolver *HostResolver) (IPInfo, int, []TargetResult, AttemptStats, error) {
 
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -1114,6 +1434,8 @@ func testSocks5Proxy(ctx context.Context, proxyAddr string, a Auth, timeout time
 	tracker := newConnTracker()
 	defer tracker.closeAll()
 
+	timing := newConnTiming()
+
 	var authSocks *proxy.Auth
 	if a.User != "" || a.Pass != "" {
 		authSocks = &proxy.Auth{User: a.User, Password: a.Pass}
@@ -1124,12 +1446,12 @@ func testSocks5Proxy(ctx context.Context, proxyAddr string, a Auth, timeout time
 	if upstreamDial != nil {
 		forward = contextDialer{DialContext: upstreamDial}
 	} else {
-		forward = baseDialer
+		forward = ipPrefDialer{base: baseDialer, pref: ipPref, timeout: timeout / 2, resolver: resolver}
 	}
 
 	dialer, err := proxy.SOCKS5("tcp", proxyAddr, authSocks, forward)
 	if err != nil {
-		return IPInfo{}, 0, err
+		return IPInfo{}, 0, nil, timing.snapshot(), err
 	}
 
 	tr := &http.Transport{
@@ -1138,7 +1460,7 @@ func testSocks5Proxy(ctx context.Context, proxyAddr string, a Auth, timeout time
 			if err != nil {
 				return nil, err
 			}
-			return tracker.track(conn), nil
+			return tracker.track(&countingConn{Conn: conn, timing: timing}), nil
 		},
 		TLSClientConfig:        &tls.Config{InsecureSkipVerify: true},
 		DisableKeepAlives:      true,
@@ -1156,47 +1478,119 @@ func testSocks5Proxy(ctx context.Context, proxyAddr string, a Auth, timeout time
 		ReadBufferSize:         4 * 1024,
 	}
 
-	rt := countingRoundTripper{base: tr, counter: reqCounter}
+	rt := countingRoundTripper{base: tr, counter: reqCounter, limiter: limiter}
 	client := &http.Client{Transport: rt, Timeout: timeout}
 
-	info, err := fetchIPInfoWithClient(ctx, client)
+	var info IPInfo
+	switch {
+	case quorum != nil:
+		info, err = quorum.Fetch(timing.withTrace(ctx), client, proxyAddr)
+	case probeEngine == probeEngineFastHTTP:
+		info, err = fetchIPInfoFast(ctx, ipChain, fastDialSocks5(dialer), timeout, proxyAddr, reqCounter)
+	default:
+		info, err = ipChain.Fetch(timing.withTrace(ctx), client, proxyAddr)
+	}
+	var targetResults []TargetResult
+	if err == nil && len(targets) > 0 {
+		targetResults = checkTestTargets(ctx, client, tr.DialContext, timeout, targets)
+	}
 	tr.CloseIdleConnections()
-	return info, info.StatusCode, err
+	return info, info.StatusCode, targetResults, timing.snapshot(), err
 }
 
 // ========== 单次尝试 ==========
 func testOne(proxyType string, proxyAddr string, a Auth, timeout time.Duration,
 	upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error),
-	reqCounter *uint64) Result {
+	reqCounter *uint64, ipPref ipVersionPref, ipChain IPInfoChain, targets []TestTarget,
+	limiter *rate.Limiter, breakers *BreakerRegistry, probeEngine string, tlsPolicy TLSPolicy, quorum *QuorumProber, resolver *HostResolver) Result {
+
+	host := hostFromHostPort(proxyAddr)
+	if breakers != nil && !breakers.Allow(host) {
+		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: strings.ToUpper(proxyType), Success: false, Err: errBreakerOpen}
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
+	var result Result
 	switch proxyType {
 	case "http":
-		info, _, err := testHTTPProxy(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter)
+		info, _, targetResults, stats, err := testHTTPProxy(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter, ipPref, ipChain, targets, limiter, probeEngine, quorum, resolver)
 		if err != nil {
-			return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTP", Success: false, Err: err, StatusCode: info.StatusCode}
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTP", Success: false, Err: err, StatusCode: info.StatusCode}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTP", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country, Provider: info.Provider, TargetResults: targetResults}
 		}
-		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTP", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
+		result.BytesIn, result.BytesOut, result.TLSMs, result.TTFBMs, result.TotalMs = stats.BytesIn, stats.BytesOut, stats.TLSMs, stats.TTFBMs, stats.TotalMs
 	case "https":
-		info, _, err := testHTTPSProxy(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter)
+		info, _, targetResults, stats, fp, err := testHTTPSProxy(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter, ipPref, ipChain, targets, limiter, probeEngine, tlsPolicy, quorum, resolver)
 		if err != nil {
-			return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTPS", Success: false, Err: err, StatusCode: info.StatusCode}
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTPS", Success: false, Err: err, StatusCode: info.StatusCode}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTPS", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country, Provider: info.Provider, TargetResults: targetResults}
 		}
-		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "HTTPS", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
+		result.BytesIn, result.BytesOut, result.TLSMs, result.TTFBMs, result.TotalMs = stats.BytesIn, stats.BytesOut, stats.TLSMs, stats.TTFBMs, stats.TotalMs
+		result.TLSVersion, result.TLSCipher, result.ALPN, result.CertCN, result.CertIssuer, result.CertSelfSigned = fp.Version, fp.Cipher, fp.ALPN, fp.CertCN, fp.CertIssuer, fp.SelfSigned
 	case "socks5":
-		info, _, err := testSocks5Proxy(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter)
+		info, _, targetResults, stats, err := testSocks5Proxy(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter, ipPref, ipChain, targets, limiter, probeEngine, quorum, resolver)
+		if err != nil {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5", Success: false, Err: err, StatusCode: info.StatusCode}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country, Provider: info.Provider, TargetResults: targetResults}
+		}
+		result.BytesIn, result.BytesOut, result.TLSMs, result.TTFBMs, result.TotalMs = stats.BytesIn, stats.BytesOut, stats.TLSMs, stats.TTFBMs, stats.TotalMs
+	case "socks4", "socks4a":
+		info, _, targetResults, stats, err := testSocks4Proxy(ctx, proxyAddr, a, timeout, upstreamDial, reqCounter, ipPref, ipChain, targets, limiter, probeEngine, quorum, resolver, proxyType == "socks4a")
+		label := strings.ToUpper(proxyType)
 		if err != nil {
-			return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5", Success: false, Err: err, StatusCode: info.StatusCode}
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: label, Success: false, Err: err, StatusCode: info.StatusCode}
+		} else {
+			result = Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: label, Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country, Provider: info.Provider, TargetResults: targetResults}
 		}
-		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: "SOCKS5", Success: true, StatusCode: info.StatusCode, ISP: info.ISP, IPType: info.IPType, Country: info.Country}
+		result.BytesIn, result.BytesOut, result.TLSMs, result.TTFBMs, result.TotalMs = stats.BytesIn, stats.BytesOut, stats.TLSMs, stats.TTFBMs, stats.TotalMs
 	default:
 		return Result{ProxyAddr: proxyAddr, Auth: a, ProxyType: strings.ToUpper(proxyType), Success: false, Err: fmt.Errorf("unknown proxy type: %s", proxyType)}
 	}
+
+	if breakers != nil {
+		breakers.RecordResult(host, result.Success, classifyErr(result.Err))
+	}
+	return result
 }
 
 // ========== 资源探测（防 OOM / 防 EMFILE） ==========
+// applyGOMEMLIMIT sets a soft Go heap limit (debug.SetMemoryLimit) derived
+// from the detected physical/container memory, unless GOMEMLIMIT is already
+// set in the environment. percent<=0 disables this entirely.
+func applyGOMEMLIMIT(percent float64) {
+	if percent <= 0 {
+		return
+	}
+	if strings.TrimSpace(os.Getenv("GOMEMLIMIT")) != "" {
+		log.Printf("GOMEMLIMIT already set via env, skipping auto-tune")
+		return
+	}
+
+	total := windowsMemLimit()
+	if total <= 0 {
+		total = unixMemLimit()
+	}
+	if total <= 0 {
+		log.Printf("GOMEMLIMIT auto-tune: unable to detect physical memory, skipped")
+		return
+	}
+
+	if percent > 100 {
+		percent = 100
+	}
+	target := int64(float64(total) * percent / 100)
+	if target <= 0 {
+		return
+	}
+	debug.SetMemoryLimit(target)
+	log.Printf("GOMEMLIMIT auto-tuned to %s (%.0f%% of detected %s)", humanBytes(target), percent, humanBytes(total))
+}
+
 func detectMemLimitBytes() int64 {
 	if s := strings.TrimSpace(os.Getenv("GOMEMLIMIT")); s != "" {
 		if v, ok := parseBytes(s); ok && v > 0 {
@@ -1264,9 +1658,26 @@ func parseBytes(s string) (int64, bool) {
 	return 0, false
 }
 
+// SystemLimits is the cross-platform view of how many resources this
+// process may safely use; detectSystemLimits is the single place that
+// reconciles rlimits, /proc, and cgroup v1/v2 so the rest of the checker
+// doesn't need to know which platform it's running on.
+type SystemLimits struct {
+	MemLimit int64  // 字节，0=未知
+	FDLimit  uint64
+}
+
+func detectSystemLimits() SystemLimits {
+	return SystemLimits{
+		MemLimit: detectMemLimitBytes(),
+		FDLimit:  detectFDLimit(),
+	}
+}
+
 func capConcurrency(requested int, unsafe bool) (final int, memLimit int64, fdLimit uint64) {
-	memLimit = detectMemLimitBytes()
-	fdLimit = detectFDLimit()
+	limits := detectSystemLimits()
+	memLimit = limits.MemLimit
+	fdLimit = limits.FDLimit
 
 	final = requested
 	if final <= 0 {
@@ -1376,7 +1787,8 @@ func readTCPConnCount() int64 {
 }
 
 // 动态并发调节：平衡性能和OOM防护，同时监控TCP连接
-func startDynamicLimiter(workers int, memLimit int64, dynamicLimit *int64, active *uint64) {
+// monitor 可为 nil（向后兼容旧调用方）；非 nil 时额外参考可用内存水位做降并发判断。
+func startDynamicLimiter(workers int, memLimit int64, dynamicLimit *int64, active *uint64, monitor *ResourceMonitor, memWatermarkBytes int64) {
 	if workers <= 0 || dynamicLimit == nil || active == nil {
 		return
 	}
@@ -1449,7 +1861,20 @@ func startDynamicLimiter(workers int, memLimit int64, dynamicLimit *int64, activ
 			shouldPause := false
 			shouldGC := false
 
-			if fdCount > fdHard {
+			// 低可用内存水位：优先于比例判断触发降并发
+			lowAvailMem := false
+			if monitor != nil && memWatermarkBytes > 0 {
+				snap := monitor.Snapshot()
+				if snap.AvailMem > 0 && snap.AvailMem < memWatermarkBytes {
+					lowAvailMem = true
+				}
+			}
+
+			if lowAvailMem {
+				curLimit = max64(minLimit, curLimit*7/10)
+				shouldPause = true
+				shouldGC = true
+			} else if fdCount > fdHard {
 				curLimit = minLimit // 硬触发直接落到最低并发，快速回收
 				paused = true
 				shouldGC = true
@@ -1537,11 +1962,33 @@ func nonEmpty(s, d string) string {
 	return s
 }
 
+// targetResultsToString renders a Result's per-target reachability bitmap as
+// "name:ok" / "name:fail(reason)" pairs joined by ",", or "-" when
+// -test-targets wasn't set.
+func targetResultsToString(trs []TargetResult) string {
+	if len(trs) == 0 {
+		return "-"
+	}
+	parts := make([]string, len(trs))
+	for i, tr := range trs {
+		if tr.Success {
+			parts[i] = tr.Name + ":ok"
+		} else {
+			parts[i] = fmt.Sprintf("%s:fail(%s)", tr.Name, nonEmpty(tr.Err, "?"))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
 func resultToLine(r Result) string {
 	var scheme string
 	switch strings.ToUpper(r.ProxyType) {
 	case "SOCKS5":
 		scheme = "socks5"
+	case "SOCKS4":
+		scheme = "socks4"
+	case "SOCKS4A":
+		scheme = "socks4a"
 	case "HTTP":
 		scheme = "http"
 	case "HTTPS":
@@ -1553,6 +2000,8 @@ func resultToLine(r Result) string {
 	isp := nonEmpty(r.ISP, "-")
 	ipType := nonEmpty(r.IPType, "-")
 	country := nonEmpty(r.Country, "-")
+	provider := nonEmpty(r.Provider, "-")
+	targets := targetResultsToString(r.TargetResults)
 
 	u := &url.URL{
 		Scheme: scheme,
@@ -1561,7 +2010,7 @@ func resultToLine(r Result) string {
 	if r.Auth.User != "" || r.Auth.Pass != "" {
 		u.User = url.UserPassword(r.Auth.User, r.Auth.Pass)
 	}
-	return fmt.Sprintf("%s#[%s][%s][%s]\n", u.String(), isp, ipType, country)
+	return fmt.Sprintf("%s#[%s][%s][%s][%s][%s]\n", u.String(), isp, ipType, country, provider, targets)
 }
 
 // ========== worker ==========
@@ -1570,6 +2019,7 @@ type Outcome struct {
 	Successes []Result
 	FailErr   error
 	FailWhy   string
+	Elapsed   time.Duration // 本次 job 的总耗时，供 -state 的 EMA 延迟使用
 }
 
 func worker(
@@ -1584,12 +2034,31 @@ func worker(
 	reqCounter *uint64,
 	active *uint64,
 	dynLimit *int64,
+	ipPref ipVersionPref,
+	ipChain IPInfoChain,
+	targets []TestTarget,
+	limiter *rate.Limiter,
+	breakers *BreakerRegistry,
+	probeEngine string,
+	tlsPolicy TLSPolicy,
+	quorum *QuorumProber,
+	resolver *HostResolver,
+	workerCount *int64,
 ) {
 	defer wg.Done()
+	if workerCount != nil {
+		defer atomic.AddInt64(workerCount, -1)
+	}
 
 	mode = strings.ToLower(mode)
 
 	for job := range jobs {
+		if job.RawLine == workerExitSentinel {
+			// -control-addr 的 "WORKERS <n>" 用它让池子里刚好一个 worker
+			// 退出，不必关掉共享的 jobs channel 影响其它 worker。
+			return
+		}
+
 		// 当动态并发或暂停信号触发时，阻塞等待
 		for {
 			if atomic.LoadUint32(&memPaused) == 1 {
@@ -1612,6 +2081,7 @@ func worker(
 		if active != nil {
 			atomic.AddUint64(active, 1)
 		}
+		jobStart := time.Now()
 		authList := make([]Auth, 0, len(auths)+1)
 		authList = append(authList, Auth{})
 		if job.InlineAuth != nil {
@@ -1635,6 +2105,10 @@ func worker(
 			types = []string{"https"}
 		case "socks5", "s5":
 			types = []string{"socks5"}
+		case "socks4":
+			types = []string{"socks4"}
+		case "socks4a":
+			types = []string{"socks4a"}
 		case "all":
 			types = guessProxyOrderWithScheme(job.ProxyAddr, job.SchemeHint)
 		case "auto":
@@ -1657,7 +2131,11 @@ func worker(
 			}
 
 			for _, a := range authList {
-				res := testOne(tp, job.ProxyAddr, a, timeout, upstreamDial, reqCounter)
+				effPref := ipPref
+				if job.IPVerHint != "" && job.IPVerHint != ipVersionAuto {
+					effPref = job.IPVerHint
+				}
+				res := testOne(tp, job.ProxyAddr, a, timeout, upstreamDial, reqCounter, effPref, ipChain, targets, limiter, breakers, probeEngine, tlsPolicy, quorum, resolver)
 				if res.Success {
 					okThisType = true
 					successes = append(successes, res)
@@ -1667,8 +2145,8 @@ func worker(
 				errClass := classifyErr(res.Err)
 				reasons = append(reasons, errClass)
 
-				// 检查是否是不可达错误（RST或网络不可达等），如果是则标记并跳过后续测试
-				if errClass == "reset" || errClass == "unreachable" || errClass == "refused" {
+				// 检查是否是不可达错误（RST、网络不可达或熔断器已打开），如果是则标记并跳过后续测试
+				if errClass == "reset" || errClass == "unreachable" || errClass == "refused" || errClass == "breaker_open" {
 					ipUnreachable = true
 					break
 				}
@@ -1689,6 +2167,7 @@ func worker(
 			Successes: successes,
 			FailErr:   lastErr,
 			FailWhy:   why,
+			Elapsed:   time.Since(jobStart),
 		}
 
 		if delay > 0 {
@@ -1759,11 +2238,15 @@ func countWorkItems(path string) (int64, error) {
 func main() {
 	log.SetFlags(0)
 
-	ipFile := flag.String("ip", "", "代理列表文件（每行一个：IP / host:port / URL / user:pass@host:port）")
+	ipFile := flag.String("ip", "", "代理列表文件（每行一个：IP / host:port / URL / user:pass@host:port）；给了 -in 则忽略")
+	var inSpecs stringList
+	flag.Var(&inSpecs, "in", "可重复指定的输入源，代替 -ip：file:path/-（stdin）/http(s)://url（按 Content-Encoding 或 .gz 后缀自动解压）/glob:pattern/zip:path/tar:path（含 .tgz/.tar.gz）；不带前缀按 file: 处理")
+	inConcurrency := flag.Int("in-concurrency", 4, "并发读取多少个 -in 输入源（bounded fan-in 进同一个 jobs 管道）")
 	portP := flag.String("p", "", "当输入行为纯 IP / 无端口 host 时使用的端口（例如 443）")
 	portLong := flag.String("port", "", "同 -p（兼容）")
 	outFile := flag.String("out", "", "输出文件（仅写入成功项）；留空自动生成")
-	modeFlag := flag.String("mode", "auto", "测试模式：http/https/socks5/all/auto（auto=测到成功就停；all=每种类型都测）")
+	outFormatFlag := flag.String("out-format", outFormatLegacy, "输出文件格式：legacy（默认，url#[isp][iptype][country][provider][targets]）/json/csv（额外带 tls_ms/ttfb_ms/total_ms/bytes_in/bytes_out）/sqlite（写入 SQLite 的 results 表，而非按行写文本）")
+	modeFlag := flag.String("mode", "auto", "测试模式：http/https/socks5/socks4/socks4a/all/auto（auto=测到成功就停；all=每种类型都测）")
 	authFile := flag.String("auth", "", "可选：认证文件 user:pass（每行一个）；留空=不带认证")
 	timeout := flag.Duration("timeout", defaultTimeout, "单次测试超时（例如 10s）")
 	delay := flag.Duration("delay", 0, "每个 IP 处理完成后的延迟（例如 10ms）")
@@ -1774,11 +2257,48 @@ func main() {
 	memPerJobFlag := flag.Int("mem-per-job", 256*1024, "自动并发单任务预估字节（设小可提高并发）")
 	gcLimitFlag := flag.Float64("gc-limit", 0.75, "GC 内存上限比例（0=不设，设大可提高并发但更易 OOM）")
 	unsafeFlag := flag.Bool("unsafe", false, "解除内存/FD/动态并发等安全限制（风险自担）")
+	memWatermarkMB := flag.Int("mem-watermark-mb", 256, "可用物理内存低于此值（MB）时触发并发收缩；0=禁用")
+	memLimitPercent := flag.Float64("mem-limit-percent", 80, "GOMEMLIMIT 占检测到的物理/容器内存上限的百分比（0=不设置）")
 
 	skipCDN := flag.Bool("skip-cdn", true, "自动跳过 CDN IP 段（联网获取）")
-	upstreamAddr := flag.String("upstream", "", "可选：上游代理 host:port")
-	upstreamMode := flag.String("upstream-mode", "s5", "上游代理协议：s5/http/https")
-	upstreamAuthStr := flag.String("upstream-auth", "", "可选：上游认证 user:pass")
+	cdnCachePath := flag.String("cdn-cache", "cdn-cache.json", "CDN CIDR 本地缓存文件路径，留空禁用缓存")
+	cdnCacheTTL := flag.Duration("cdn-cache-ttl", 24*time.Hour, "CDN CIDR 缓存有效期，过期后重新联网获取")
+	cdnAllowFlag := flag.String("cdn-allow", "", "可选：仅保留指定 CDN 提供商（逗号分隔，如 cloudflare,fastly），留空表示全部")
+	cdnExtraFlag := flag.String("cdn-extra", "", "可选：额外 CDN/IP 段来源，逗号分隔的 name=url 列表（返回按行分隔的 CIDR 文本），用于 Akamai/Azure/Bunny/DigitalOcean 等没有固定官方端点的提供商")
+	upstreamAddr := flag.String("upstream", "", "可选：上游代理 host:port，支持逗号分隔的多跳链（如 socks5://user:pass@a:1080,https://b:443）")
+	upstreamMode := flag.String("upstream-mode", "s5", "上游代理协议：s5/http/https（链中某一跳省略 scheme:// 前缀时使用此默认值）")
+	upstreamAuthStr := flag.String("upstream-auth", "", "可选：上游认证 user:pass（仅用于链中省略 scheme:// 前缀的第一跳）")
+	chainFlag := flag.String("chain", "", "可选：improved 流水线专用的多跳上游代理链，逗号分隔且每跳必须带 scheme://（如 socks5://user:pass@a:1080,https://b:8443,http://c:3128），用于验证一个候选代理在经过已知可用的前置代理（如公司出口代理）时是否仍然可用；启动时仅做语法校验")
+	ipVersionFlag := flag.String("ip-version", "auto", "IP 版本偏好：auto/v4-only/v6-only/v4-prefer/v6-prefer（单行可用 scheme+v4/scheme+v6 覆盖，如 socks5+v6://host:port）")
+	resolverFlag := flag.String("resolver", "", "可选：自定义 DNS 解析器，代替系统 DNS 解析代理地址本身（doh://host/path、udp://ip:port、dot://host:port）；带内置 LRU+TTL 缓存，同一 host 跨 -auth/端口只解析一次，留空=使用系统解析器")
+	ipInfoFlag := flag.String("ipinfo", "furry", "IP 信息来源，按优先级逗号分隔：furry/ipinfo.io/ip-api.com/ipwho.is/ifconfig.co/mmdb，失败时按顺序回退下一个")
+	mmdbPath := flag.String("mmdb-path", "", "mmdb 数据源对应的 MaxMind/IP2Location 数据库文件路径（-ipinfo 含 mmdb 时必填）")
+	testTargetsFlag := flag.String("test-targets", "", "可选：额外可达性矩阵，分号分隔的 name=url[,expect-status[,expect-substring[,weight]]] 列表；url 可用内置值 acme-tls-alpn 测试本地自签 ALPN h2 源（验证代理端到端 TLS+ALPN 可达性）")
+	stateFile := flag.String("state", "", "可选：持久化状态文件（BoltDB），跨多次运行记录每个代理的成功/失败次数、EMA 延迟与最后错误；留空不持久化")
+	cooldown := flag.Duration("cooldown", time.Hour, "已知失败的代理在此时长内跳过复测（已知可用的代理按此时长的 6 倍跳过复测）；仅在 -state 生效")
+	resumeFlag := flag.Bool("resume", false, "仅重放 -state 中状态为 pending 的代理（上次运行被中断后续跑）；仅在 -state 生效")
+	requeueAfter := flag.Duration("resume-requeue-after", 0, "已知可用的代理超过此时长未复测就强制重测，忽略 -cooldown 的 6 倍跳过窗口；0=不启用；仅在 -state 生效")
+	stateCompactAfter := flag.Duration("state-compact-after", 0, "启动时清理 -state 中超过此时长未被复测过的行，防止状态库无限增长；0=不清理；仅在 -state 生效")
+	adminAddr := flag.String("admin-addr", "", "可选：启动一个 HTTP 接口（如 :9090），GET /stats 返回 CounterMap/状态库行数/最慢与最常失败代理的实时 JSON 快照")
+	controlAddr := flag.String("control-addr", "", "可选：启动一个 TCP 控制端口（如 :9091），支持纯文本命令 STATS/RATE <n>/WORKERS <n>/REASONS/FLUSH/QUIT（nc/telnet 均可连接）；留空不启动")
+	metricsAddr := flag.String("metrics-addr", "", "可选：启动一个 Prometheus 文本暴露格式的 HTTP 接口（如 :9090），GET /metrics 返回 improved 测试路径（testOneImproved）的尝试数/按类型与国家的成功率/延迟直方图/并发与内存水位；主流程的 worker 池走的是 testOne，不经过 improved 路径，所以这些计数器在当前快照下始终为 0；留空不启动")
+	redisAddr := flag.String("redis-addr", "", "可选：启用分布式工作池模式（如 127.0.0.1:6379），需同时指定 -redis-role")
+	redisRoleFlag := flag.String("redis-role", "", "分布式角色：coordinator（扫描 -ip-file 并派发任务到 Redis，汇总结果写 -out/-state）/worker（从 Redis 取任务跑本地 worker 池，结果回写 Redis）；仅在 -redis-addr 生效")
+	nodeIDFlag := flag.String("node-id", "", "worker 节点 id，用于一致性哈希分片与 Redis 心跳注册；留空自动生成（hostname-pid）")
+	vnodesFlag := flag.Int("vnodes", 100, "一致性哈希环每个节点的虚拟节点数，越大分片越均衡；仅在 -redis-role=worker 生效")
+	redisIdleShutdown := flag.Duration("redis-idle-shutdown", 30*time.Second, "worker 从 Redis 任务队列连续空取超过此时长就判定任务已派发完毕并退出；仅在 -redis-role=worker 生效")
+	rateFlag := flag.Float64("rate", 0, "全局请求限速（次/秒，golang.org/x/time/rate 令牌桶）；0=不限速")
+	burstFlag := flag.Int("burst", 0, "令牌桶突发容量；0=等于 -rate 向上取整（仅在 -rate>0 时生效）")
+	breakerFails := flag.Int("breaker-fails", 5, "单个代理 IP 连续多少次 refused/unreachable/reset/timeout 后熔断该 host；0=禁用熔断器")
+	breakerWindow := flag.Duration("breaker-window", 30*time.Second, "熔断器连续失败计数的滑动窗口")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "熔断器打开后的冷却时长，之后进入半开态放行一次探测")
+	probeEngineFlag := flag.String("probe-engine", "net/http", "ipinfo 探测使用的 HTTP 引擎：net/http（默认）/fasthttp（高并发下分配更少，仅影响 ipinfo 请求，不影响 -test-targets）")
+	tlsMinFlag := flag.String("tls-min", "1.2", "仅 HTTPS/CONNECT 代理：到目标的 TLS 握手最低版本（1.0/1.1/1.2/1.3）")
+	requireALPNFlag := flag.String("require-alpn", "", "仅 HTTPS/CONNECT 代理：逗号分隔的 ALPN 允许列表（例如 h2,http/1.1），协商结果不在列表内则判定失败；留空=不过滤")
+	probeModeFlag := flag.String("probe-mode", probeModeChain, "ipinfo 探测策略：chain（默认，按 -ipinfo 顺序依次尝试）/quorum（并发查询 -probe-urls 并要求多数一致，用于识别代理伪造/劫持 ipinfo 响应）")
+	probeURLsFlag := flag.String("probe-urls", "ip-api.com,ipinfo.io,ifconfig.co", "仅 -probe-mode=quorum：逗号分隔的 provider 名（取自内置 registry）或裸 URL，并发探测")
+	probeQuorumFlag := flag.Int("probe-quorum", 2, "仅 -probe-mode=quorum：多少个 provider 对出口 IP 达成一致才算通过")
+	probeParallelFlag := flag.Int("probe-parallel", 3, "仅 -probe-mode=quorum：并发探测多少个 -probe-urls provider（0=全部）")
 
 	flag.Parse()
 	if *memBudgetFlag > 0 && *memBudgetFlag <= 1 {
@@ -1796,21 +2316,76 @@ func main() {
 		}
 	}
 
-	if strings.TrimSpace(*ipFile) == "" {
-		log.Println("必须提供 -ip")
+	applyGOMEMLIMIT(*memLimitPercent)
+
+	if len(inSpecs) == 0 && strings.TrimSpace(*ipFile) == "" {
+		log.Println("必须提供 -ip 或至少一个 -in")
 		flag.Usage()
 		os.Exit(2)
 	}
 
+	inputSources, err := resolveInputSpecs(inSpecs, *ipFile)
+	if err != nil {
+		log.Fatalf("解析 -in/-ip 失败: %v", err)
+	}
+
 	if *portP == "" && *portLong != "" {
 		*portP = *portLong
 	}
 
 	mode := strings.ToLower(strings.TrimSpace(*modeFlag))
 	switch mode {
-	case "http", "https", "socks5", "s5", "all", "auto":
+	case "http", "https", "socks5", "s5", "socks4", "socks4a", "all", "auto":
+	default:
+		log.Fatalf("无效的 -mode=%s，应为 http/https/socks5/socks4/socks4a/all/auto", mode)
+	}
+
+	switch *probeEngineFlag {
+	case "net/http", probeEngineFastHTTP:
+	default:
+		log.Fatalf("无效的 -probe-engine=%s，应为 net/http/fasthttp", *probeEngineFlag)
+	}
+
+	switch *outFormatFlag {
+	case outFormatLegacy, outFormatJSON, outFormatCSV, outFormatSQLite:
+	default:
+		log.Fatalf("无效的 -out-format=%s，应为 legacy/json/csv/sqlite", *outFormatFlag)
+	}
+
+	switch *redisRoleFlag {
+	case "", redisRoleCoordinator, redisRoleWorker:
+	default:
+		log.Fatalf("无效的 -redis-role=%s，应为 coordinator/worker", *redisRoleFlag)
+	}
+	if *redisAddr == "" && *redisRoleFlag != "" {
+		log.Fatalf("-redis-role 需要同时指定 -redis-addr")
+	}
+	if *redisAddr != "" && *redisRoleFlag == "" {
+		log.Fatalf("-redis-addr 需要同时指定 -redis-role=coordinator/worker")
+	}
+	nodeID := *nodeIDFlag
+	if *redisRoleFlag == redisRoleWorker && nodeID == "" {
+		host, _ := os.Hostname()
+		nodeID = fmt.Sprintf("%s-%d", nonEmpty(host, "node"), os.Getpid())
+	}
+
+	tlsMinVersion, err := parseTLSVersion(*tlsMinFlag)
+	if err != nil {
+		log.Fatalf("无效的 -tls-min=%s: %v", *tlsMinFlag, err)
+	}
+	tlsPolicy := TLSPolicy{MinVersion: tlsMinVersion, RequireALPN: parseALPNAllowlist(*requireALPNFlag)}
+
+	var quorum *QuorumProber
+	switch *probeModeFlag {
+	case probeModeChain:
+	case probeModeQuorum:
+		quorumProviders, err := buildQuorumProviders(*probeURLsFlag)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		quorum = newQuorumProber(quorumProviders, *probeQuorumFlag, *probeParallelFlag)
 	default:
-		log.Fatalf("无效的 -mode=%s，应为 http/https/socks5/all/auto", mode)
+		log.Fatalf("无效的 -probe-mode=%s，应为 chain/quorum", *probeModeFlag)
 	}
 
 	// 当未指定端口时，从 mode 推断默认端口
@@ -1820,7 +2395,7 @@ func main() {
 			*portP = "443"
 		case "http":
 			*portP = "80"
-		case "socks5", "s5":
+		case "socks5", "s5", "socks4", "socks4a":
 			*portP = "1080"
 		}
 	}
@@ -1834,12 +2409,12 @@ func main() {
 		*outFile = fmt.Sprintf("result_mode-%s_port-%s_%s.txt", mode, p, ts)
 	}
 
-	total, err := countWorkItems(*ipFile)
-	if err != nil {
-		log.Fatalf("统计 IP 行数失败: %v", err)
+	total := countInputSources(inputSources)
+	if total == 0 && allSourcesCountable(inputSources) {
+		log.Fatalf("输入源为空或全是注释/空行")
 	}
 	if total == 0 {
-		log.Fatalf("IP 文件为空或全是注释/空行")
+		log.Printf("注意：-in 含 stdin/http(s)/archive 等无法预统计行数的源，-progress 的 total/ETA 在扫描完成前不准确")
 	}
 
 	auths, err := loadAuthsOptional(*authFile)
@@ -1851,15 +2426,82 @@ func main() {
 	if *skipCDN {
 		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 		defer cancel()
-		cdn, err = loadCDNFilter(ctx)
+		cdn, err = loadCDNFilter(ctx, *cdnCachePath, *cdnCacheTTL, parseCDNAllowList(*cdnAllowFlag), parseCDNExtraSources(*cdnExtraFlag))
 		if err != nil {
 			log.Printf("CDN 列表获取失败，将不跳过 CDN：%v", err)
 			cdn = nil
 		} else {
-			log.Printf("CDN 列表已加载：v4=%d v6=%d（cloudflare/fastly/cloudfront）", len(cdn.V4), len(cdn.V6))
+			log.Printf("CDN 列表已加载：v4=%d v6=%d", len(cdn.V4), len(cdn.V6))
 		}
 	}
 
+	ipPref := parseIPVersionPref(*ipVersionFlag)
+
+	var hostResolver *HostResolver
+	if strings.TrimSpace(*resolverFlag) != "" {
+		hostResolver, err = newHostResolver(*resolverFlag)
+		if err != nil {
+			log.Fatalf("创建 -resolver 失败: %v", err)
+		}
+	}
+
+	ipChain, err := buildIPInfoChain(*ipInfoFlag, *mmdbPath, *timeout)
+	if err != nil {
+		log.Fatalf("创建 ipinfo 来源链失败: %v", err)
+	}
+
+	testTargets, err := parseTestTargets(*testTargetsFlag)
+	if err != nil {
+		log.Fatalf("解析 -test-targets 失败: %v", err)
+	}
+
+	failReasons := &CounterMap{}
+	skipReasons := &CounterMap{}
+
+	var stateStore *StateStore
+	if *stateFile != "" {
+		stateStore, err = openStateStore(*stateFile)
+		if err != nil {
+			log.Fatalf("打开 -state 失败: %v", err)
+		}
+		defer stateStore.Close()
+		if *stateCompactAfter > 0 {
+			removed, err := stateStore.Compact(*stateCompactAfter)
+			if err != nil {
+				log.Printf("-state 压缩失败: %v", err)
+			} else if removed > 0 {
+				log.Printf("-state 压缩：清理了 %d 条超过 %s 未复测的行", removed, stateCompactAfter.String())
+			}
+		}
+	} else if *resumeFlag {
+		log.Fatalf("-resume 需要同时指定 -state")
+	} else if *requeueAfter > 0 || *stateCompactAfter > 0 {
+		log.Fatalf("-resume-requeue-after/-state-compact-after 需要同时指定 -state")
+	}
+
+	var rq *RedisQueue
+	if *redisAddr != "" {
+		rq, err = openRedisQueue(*redisAddr)
+		if err != nil {
+			log.Fatalf("连接 -redis-addr 失败: %v", err)
+		}
+		defer rq.Close()
+		log.Printf("分布式模式：role=%s node-id=%s redis=%s", *redisRoleFlag, nodeID, *redisAddr)
+	}
+
+	var limiter *rate.Limiter
+	if *rateFlag > 0 {
+		burst := *burstFlag
+		if burst <= 0 {
+			burst = int(*rateFlag + 0.999)
+			if burst < 1 {
+				burst = 1
+			}
+		}
+		limiter = rate.NewLimiter(rate.Limit(*rateFlag), burst)
+	}
+	breakers := newBreakerRegistry(*breakerFails, *breakerWindow, *breakerCooldown)
+
 	var upstreamDial func(ctx context.Context, network, addr string) (net.Conn, error)
 	if *upstreamAddr != "" {
 		var ua Auth
@@ -1869,12 +2511,18 @@ func main() {
 				ua.User, ua.Pass = parts[0], parts[1]
 			}
 		}
-		upstreamDial, err = buildUpstreamDialer(*upstreamMode, *upstreamAddr, ua, *timeout)
+		upstreamDial, err = buildUpstreamDialer(*upstreamMode, *upstreamAddr, ua, *timeout, ipPref, failReasons)
 		if err != nil {
 			log.Fatalf("创建上游代理失败: %v", err)
 		}
 	}
 
+	// -chain 只被 improvements_linux.go 里未接入 worker 的 improved 流水线使用，
+	// 这里仅做启动期语法校验（提前暴露拼写错误），不在主流程中持有结果。
+	if err := validateChainFlag(*chainFlag); err != nil {
+		log.Fatalf("解析 -chain 失败: %v", err)
+	}
+
 	workers, memLimit, fdLimit := capConcurrency(*concurrency, *unsafeFlag)
 
 	var (
@@ -1886,27 +2534,76 @@ func main() {
 		reqCnt  uint64
 		activeW uint64
 		dynLim  int64
+
+		// emaIPSBits/emaQPSBits are math.Float64bits snapshots of the
+		// progress ticker's smoothed rates, so -control-addr's STATS
+		// can read them via atomic.LoadUint64 instead of a mutex.
+		emaIPSBits uint64
+		emaQPSBits uint64
 	)
 
+	var resMonitor *ResourceMonitor
 	if !*unsafeFlag {
 		startMemReclaimer(memLimit)
 		atomic.StoreInt64(&dynLim, int64(workers))
-		startDynamicLimiter(workers, memLimit, &dynLim, &activeW)
-	}
-
-	log.Printf("start: ips=%d mode=%s timeout=%s concurrency=%d memLimit=%s fdLimit=%d out=%s unsafe=%v",
-		total, mode, timeout.String(), workers, humanBytes(memLimit), fdLimit, *outFile, *unsafeFlag)
 
-	out, err := os.Create(*outFile)
-	if err != nil {
-		log.Fatalf("创建输出文件失败(%s): %v", *outFile, err)
+		resMonitor = newResourceMonitor(3 * time.Second)
+		resMonitor.Start()
+
+		var memWatermarkBytes int64
+		if *memWatermarkMB > 0 {
+			memWatermarkBytes = int64(*memWatermarkMB) * 1024 * 1024
+		}
+		startDynamicLimiter(workers, memLimit, &dynLim, &activeW, resMonitor, memWatermarkBytes)
+	}
+
+	log.Printf("start: ips=%d mode=%s timeout=%s concurrency=%d memLimit=%s fdLimit=%d out=%s out-format=%s unsafe=%v ip-version=%s ipinfo=%s test-targets=%d state=%s resume=%v resume-requeue-after=%s rate=%v breaker-fails=%d probe-engine=%s tls-min=%s require-alpn=%v probe-mode=%s resolver=%s",
+		total, mode, timeout.String(), workers, humanBytes(memLimit), fdLimit, *outFile, *outFormatFlag, *unsafeFlag, ipPref, *ipInfoFlag, len(testTargets), *stateFile, *resumeFlag, requeueAfter.String(), *rateFlag, *breakerFails, *probeEngineFlag, *tlsMinFlag, tlsPolicy.RequireALPN, *probeModeFlag, nonEmpty(*resolverFlag, "system"))
+
+	var adminCancel context.CancelFunc
+	if *adminAddr != "" {
+		var adminCtx context.Context
+		adminCtx, adminCancel = context.WithCancel(context.Background())
+		startAdminServer(adminCtx, *adminAddr, stateStore, failReasons, skipReasons)
+		log.Printf("admin 接口已启动：http://%s/stats", *adminAddr)
+	}
+
+	var metricsCancel context.CancelFunc
+	if *metricsAddr != "" {
+		// improvedMetrics 目前只有 improved 测试路径（testOneImproved/
+		// startDynamicLimiterImproved）会写入；主流程的 worker 池走的是
+		// testOne，不经过这里，所以在当前快照下这些计数器会保持为 0。
+		var metricsCtx context.Context
+		metricsCtx, metricsCancel = context.WithCancel(context.Background())
+		startMetricsServer(metricsCtx, *metricsAddr, newImprovedMetrics())
+		log.Printf("metrics 接口已启动：http://%s/metrics", *metricsAddr)
+	}
+
+	// quitScan, closed exactly once via quitScanOnce, is how -control-addr's
+	// QUIT command ends a scan early: the -ip scan goroutine checks it
+	// non-blockingly each line and, once closed, returns through the same
+	// defer close(jobs) it would hit at EOF — no separate drain path needed.
+	quitScan := make(chan struct{})
+	scanCtx, cancelScan := context.WithCancel(context.Background())
+	defer cancelScan()
+	var quitScanOnce sync.Once
+	requestQuit := func() {
+		quitScanOnce.Do(func() {
+			close(quitScan)
+			cancelScan()
+		})
 	}
-	defer out.Close()
-	writer := bufio.NewWriterSize(out, 512*1024)
-	defer writer.Flush()
 
-	failReasons := &CounterMap{}
-	skipReasons := &CounterMap{}
+	// worker 角色不落盘：它的结果经 rq.PushOutcome 回传给 coordinator，由
+	// coordinator 那一侧的 outWriter 写 -out。
+	var outWriter OutputWriter
+	if *redisRoleFlag != redisRoleWorker {
+		outWriter, err = openOutputWriter(*outFile, *outFormatFlag)
+		if err != nil {
+			log.Fatalf("创建输出文件失败(%s): %v", *outFile, err)
+		}
+		defer outWriter.Close()
+	}
 
 	jobQueueSize := min(max(128, workers/4), 4096)
 	jobs := make(chan Job, jobQueueSize)
@@ -1946,6 +2643,8 @@ func main() {
 				} else {
 					emaQPS = emaQPS*0.80 + curQPS*0.20
 				}
+				atomic.StoreUint64(&emaIPSBits, math.Float64bits(emaIPS))
+				atomic.StoreUint64(&emaQPSBits, math.Float64bits(emaQPS))
 
 				lastDone = d
 				lastReq = r
@@ -1969,34 +2668,88 @@ func main() {
 		}
 	}()
 
+	stopRedis := make(chan struct{})
+	if rq != nil {
+		rctx, rcancel := context.WithCancel(context.Background())
+		defer rcancel()
+		switch *redisRoleFlag {
+		case redisRoleWorker:
+			// 心跳注册节点 + 周期性把本地原子计数器发布到 Redis，供
+			// coordinator 的进度汇总读取。
+			go func() {
+				t := time.NewTicker(redisHeartbeatEvery)
+				defer t.Stop()
+				for {
+					_ = rq.Heartbeat(rctx, nodeID)
+					stats := map[string]uint64{
+						"done": atomic.LoadUint64(&done), "okIP": atomic.LoadUint64(&okIP),
+						"fail": atomic.LoadUint64(&fail), "skip": atomic.LoadUint64(&skip),
+						"activeW": atomic.LoadUint64(&activeW), "dynLim": uint64(atomic.LoadInt64(&dynLim)),
+					}
+					_ = rq.PublishStats(rctx, nodeID, stats)
+					select {
+					case <-stopRedis:
+						return
+					case <-t.C:
+					}
+				}
+			}()
+		case redisRoleCoordinator:
+			go func() {
+				t := time.NewTicker(5 * time.Second)
+				defer t.Stop()
+				for {
+					select {
+					case <-stopRedis:
+						return
+					case <-t.C:
+						agg, err := rq.AggregateStats(rctx)
+						if err != nil {
+							continue
+						}
+						fmt.Fprintf(os.Stderr, "fleet: done=%d okIP=%d fail=%d skip=%d activeW=%d dynLim=%d\n",
+							agg["done"], agg["okIP"], agg["fail"], agg["skip"], agg["activeW"], agg["dynLim"])
+					}
+				}
+			}()
+		}
+	}
+
 	var writeWg sync.WaitGroup
 	writeWg.Add(1)
-	go func() {
-		defer writeWg.Done()
-		flushTicker := time.NewTicker(500 * time.Millisecond)
-		defer flushTicker.Stop()
-
-		pending := 0
-		for {
-			select {
-			case oc, ok := <-outcomes:
-				if !ok {
-					_ = writer.Flush()
-					return
+	if *redisRoleFlag == redisRoleWorker {
+		// worker 不落盘：把每个 Outcome 原样 RPUSH 回 Redis 的结果队列，
+		// 交给 coordinator 那一侧的 outWriter/-state 去处理。
+		go func() {
+			defer writeWg.Done()
+			for oc := range outcomes {
+				if err := rq.PushOutcome(context.Background(), oc); err != nil {
+					log.Printf("push outcome to redis fail: %v", err)
 				}
-
+				if len(oc.Successes) > 0 {
+					atomic.AddUint64(&okIP, 1)
+					atomic.AddUint64(&okLine, uint64(len(oc.Successes)))
+				} else {
+					atomic.AddUint64(&fail, 1)
+					failReasons.Inc(oc.FailWhy)
+				}
+				atomic.AddUint64(&done, 1)
+			}
+		}()
+	} else {
+		go func() {
+			defer writeWg.Done()
+			// Batching/flush cadence lives in the OutputWriter itself now
+			// (see output.go's outputFlushEvery/outputFlushInterval), so
+			// this loop just forwards results and does a final Flush once
+			// outcomes closes.
+			for oc := range outcomes {
 				if len(oc.Successes) > 0 {
 					atomic.AddUint64(&okIP, 1)
 					atomic.AddUint64(&okLine, uint64(len(oc.Successes)))
 					for _, r := range oc.Successes {
-						if _, err := writer.WriteString(resultToLine(r)); err != nil {
+						if err := outWriter.WriteResult(r); err != nil {
 							log.Printf("write fail: %v", err)
-						} else {
-							pending++
-							if pending >= 256 {
-								_ = writer.Flush()
-								pending = 0
-							}
 						}
 					}
 				} else {
@@ -2007,79 +2760,192 @@ func main() {
 					}
 				}
 
-				atomic.AddUint64(&done, 1)
+				if stateStore != nil {
+					stateStore.RecordResult(oc.ProxyAddr, len(oc.Successes) > 0, oc.Elapsed, oc.FailWhy)
+				}
 
-			case <-flushTicker.C:
-				_ = writer.Flush()
-				pending = 0
+				atomic.AddUint64(&done, 1)
 			}
-		}
-	}()
+			_ = outWriter.Flush()
+		}()
+	}
 
 	var wg sync.WaitGroup
-	for i := 0; i < workers; i++ {
+	var liveWorkers int64
+	spawnWorker := func() {
 		wg.Add(1)
-		go worker(&wg, jobs, outcomes, auths, *timeout, mode, *delay, upstreamDial, &reqCnt, &activeW, &dynLim)
-	}
+		atomic.AddInt64(&liveWorkers, 1)
+		go worker(&wg, jobs, outcomes, auths, *timeout, mode, *delay, upstreamDial, &reqCnt, &activeW, &dynLim, ipPref, ipChain, testTargets, limiter, breakers, *probeEngineFlag, tlsPolicy, quorum, hostResolver, &liveWorkers)
+	}
+	// shrinkWorkers drops n workers by handing each a sentinel job over the
+	// shared jobs channel, rather than closing jobs (which would stop the
+	// whole pool) or adding a second coordination channel per worker.
+	shrinkWorkers := func(n int) {
+		for i := 0; i < n; i++ {
+			jobs <- Job{RawLine: workerExitSentinel}
+		}
+	}
+	if *redisRoleFlag != redisRoleCoordinator {
+		// coordinator 只管派发/汇总，实际探测由远端 worker 进程做。
+		for i := 0; i < workers; i++ {
+			spawnWorker()
+		}
+	}
+
+	var controlCancel context.CancelFunc
+	if *controlAddr != "" {
+		var controlCtx context.Context
+		controlCtx, controlCancel = context.WithCancel(context.Background())
+		if _, err := startControlServer(controlCtx, *controlAddr, &ControlDeps{
+			Total:         uint64(total),
+			Done:          &done,
+			OkIP:          &okIP,
+			OkLine:        &okLine,
+			Fail:          &fail,
+			Skip:          &skip,
+			ReqCnt:        &reqCnt,
+			ActiveW:       &activeW,
+			DynLim:        &dynLim,
+			LiveWorkers:   &liveWorkers,
+			EMAIPSBits:    &emaIPSBits,
+			EMAQPSBits:    &emaQPSBits,
+			FailReasons:   failReasons,
+			SkipReasons:   skipReasons,
+			OutWriter:     outWriter,
+			SpawnWorker:   spawnWorker,
+			ShrinkWorkers: shrinkWorkers,
+			RequestQuit:   requestQuit,
+		}); err != nil {
+			log.Fatalf("启动 -control-addr 失败: %v", err)
+		}
+		log.Printf("control 接口已启动：%s", *controlAddr)
+	}
+
+	if *redisRoleFlag == redisRoleWorker {
+		ring := newHashRing(*vnodesFlag)
+		_ = rq.Heartbeat(scanCtx, nodeID) // 立即注册，不等第一次心跳 tick
+		// scanCtx (not context.Background()) so -control-addr's QUIT
+		// (requestQuit -> cancelScan) actually stops a redis worker instead
+		// of leaving it popping jobs forever.
+		go runRedisJobFeeder(scanCtx, rq, jobs, ring, nodeID, *redisIdleShutdown)
+	} else {
+		rawLines := make(chan sourceLine, jobQueueSize)
+		go feedInputSources(scanCtx, inputSources, *inConcurrency, stateStore, rawLines, skipReasons)
 
-	go func() {
-		defer close(jobs)
+		go func() {
+			defer close(jobs)
 
-		f, err := os.Open(*ipFile)
-		if err != nil {
-			log.Printf("open ip file failed: %v", err)
-			return
-		}
-		defer f.Close()
+			for sl := range rawLines {
+				select {
+				case <-quitScan:
+					// -control-addr 收到 QUIT：提前结束扫描，走跟正常
+					// 读完所有源一样的 defer close(jobs) 收尾路径。
+					return
+				default:
+				}
 
-		sc := bufio.NewScanner(f)
-		sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+				raw := strings.TrimSpace(sl.raw)
+				if raw == "" || strings.HasPrefix(raw, "#") {
+					continue
+				}
 
-		for sc.Scan() {
-			raw := strings.TrimSpace(sc.Text())
-			if raw == "" || strings.HasPrefix(raw, "#") {
-				continue
-			}
+				addr, schemeHint, ipVerHint, inlineAuth, err := parseProxyLine(raw, *portP)
+				if err != nil {
+					atomic.AddUint64(&skip, 1)
+					skipReasons.Inc("bad_line")
+					atomic.AddUint64(&done, 1)
+					continue
+				}
 
-			addr, schemeHint, inlineAuth, err := parseProxyLine(raw, *portP)
-			if err != nil {
-				atomic.AddUint64(&skip, 1)
-				skipReasons.Inc("bad_line")
-				atomic.AddUint64(&done, 1)
-				continue
-			}
+				if cdn != nil {
+					host := hostFromHostPort(addr)
+					ip := net.ParseIP(strings.Trim(host, "[]"))
+					if ip != nil {
+						if provider, ok := cdn.MatchWithProvider(ip); ok {
+							atomic.AddUint64(&skip, 1)
+							skipReasons.Inc("cdn_" + provider)
+							atomic.AddUint64(&done, 1)
+							continue
+						}
+					}
+				}
 
-			if cdn != nil {
-				host := hostFromHostPort(addr)
-				ip := net.ParseIP(strings.Trim(host, "[]"))
-				if ip != nil {
-					if provider, ok := cdn.Match(ip); ok {
+				if stateStore != nil {
+					if skipped, why := stateStore.ShouldSkip(addr, *cooldown, *resumeFlag, *requeueAfter); skipped {
 						atomic.AddUint64(&skip, 1)
-						skipReasons.Inc("cdn_" + provider)
+						skipReasons.Inc(why)
 						atomic.AddUint64(&done, 1)
 						continue
 					}
+					stateStore.MarkPending(addr)
 				}
-			}
 
-			jobs <- Job{
-				ProxyAddr:  addr,
-				SchemeHint: schemeHint,
-				InlineAuth: inlineAuth,
-				RawLine:    raw,
+				job := Job{
+					ProxyAddr:  addr,
+					SchemeHint: schemeHint,
+					IPVerHint:  ipVerHint,
+					InlineAuth: inlineAuth,
+					RawLine:    raw,
+				}
+				if *redisRoleFlag == redisRoleCoordinator {
+					if err := rq.PushJob(context.Background(), job); err != nil {
+						log.Printf("push job to redis fail: %v", err)
+						atomic.AddUint64(&skip, 1)
+						skipReasons.Inc("redis_push_fail")
+						atomic.AddUint64(&done, 1)
+					}
+				} else {
+					jobs <- job
+				}
 			}
-		}
-		if err := sc.Err(); err != nil {
-			log.Printf("scan ip file error: %v", err)
-		}
-	}()
+		}()
+	}
+
+	if *redisRoleFlag == redisRoleCoordinator {
+		// coordinator 没有本地 worker 往 outcomes 里塞结果，改由这个
+		// goroutine 从 Redis 结果队列里取，塞给现有的写出 goroutine；直到
+		// done 追上 total（全部任务都有结果）才收尾。
+		go func() {
+			rctx := context.Background()
+			for atomic.LoadUint64(&done) < uint64(total) {
+				oc, err := rq.PopOutcome(rctx, 2*time.Second)
+				if err != nil {
+					time.Sleep(time.Second)
+					continue
+				}
+				if oc == nil {
+					continue
+				}
+				outcomes <- *oc
+			}
+			close(outcomes)
+		}()
+	} else {
+		go func() {
+			wg.Wait()
+			close(outcomes)
+		}()
+	}
 
-	wg.Wait()
-	close(outcomes)
 	writeWg.Wait()
 	close(stopProg)
+	close(stopRedis)
+	if resMonitor != nil {
+		resMonitor.Close()
+	}
+	if adminCancel != nil {
+		adminCancel()
+	}
+	if controlCancel != nil {
+		controlCancel()
+	}
+	if metricsCancel != nil {
+		metricsCancel()
+	}
 
-	_ = writer.Flush()
+	if outWriter != nil {
+		_ = outWriter.Flush()
+	}
 	fmt.Fprintf(os.Stderr, "done. out=%s okIP=%d okLines=%d fail=%d skip=%d\n",
 		*outFile,
 		atomic.LoadUint64(&okIP),
@@ -0,0 +1,17 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// readSysctlMemsize returns physical memory size via the BSD/Darwin
+// "hw.memsize" sysctl (falls back to 0 on BSDs that don't expose it under
+// that name).
+func readSysctlMemsize() int64 {
+	v, err := unix.SysctlUint64("hw.memsize")
+	if err != nil || v == 0 {
+		return 0
+	}
+	return int64(v)
+}
@@ -0,0 +1,10 @@
+//go:build linux
+// +build linux
+
+package main
+
+// readSysctlMemsize is not applicable on Linux; MemTotal comes from
+// /proc/meminfo instead (see readMemTotal).
+func readSysctlMemsize() int64 {
+	return 0
+}
@@ -0,0 +1,60 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixMemLimit returns the effective physical memory ceiling for this
+// process on unix: the smaller of the cgroup v2/v1 limit (if present) and
+// /proc/meminfo MemTotal. Returns 0 if undetectable.
+func unixMemLimit() int64 {
+	total := readMemTotal()
+	if cg := readCgroupMemLimit(); cg > 0 && (total <= 0 || cg < total) {
+		return cg
+	}
+	return total
+}
+
+func readMemTotal() int64 {
+	if v := readSysctlMemsize(); v > 0 {
+		return v
+	}
+	b, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, ln := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(ln, "MemTotal:") {
+			continue
+		}
+		if kb, ok := parseMeminfoKB(ln); ok {
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+func readCgroupMemLimit() int64 {
+	// cgroup v2
+	if b, err := os.ReadFile("/sys/fs/cgroup/memory.max"); err == nil {
+		txt := strings.TrimSpace(string(b))
+		if txt != "" && txt != "max" {
+			if v, err := strconv.ParseInt(txt, 10, 64); err == nil && v > 0 {
+				return v
+			}
+		}
+	}
+	// cgroup v1
+	if b, err := os.ReadFile("/sys/fs/cgroup/memory/memory.limit_in_bytes"); err == nil {
+		txt := strings.TrimSpace(string(b))
+		if v, err := strconv.ParseInt(txt, 10, 64); err == nil && v > 0 && v < 1<<62 {
+			return v
+		}
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+// unixMemLimit reports 0 on Windows.
+func unixMemLimit() int64 {
+	return 0
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ============================================================
+// --metrics-addr: Prometheus 文本暴露格式的 /metrics 端点
+// ============================================================
+//
+// 这套计数器只服务于 improved 测试路径（testOneImproved/
+// startDynamicLimiterImproved，见 improvements_linux.go）：长时间扫描靠
+// stdout 日志行很难做仪表盘和告警，这里把同样的信息换成 Prometheus 能抓取
+// 的格式。*ImprovedMetrics 上的方法都是 nil-safe，调用方不需要在每个调用
+// 点判空。
+
+// improvedLatencyBucketsSeconds are the histogram bucket upper bounds for
+// proxychecker_improved_latency_seconds, roughly matching the timeouts a
+// proxy checker actually cares about (sub-second to 30s).
+var improvedLatencyBucketsSeconds = []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30}
+
+// ImprovedMetrics aggregates counters/gauges from the improved test path
+// for --metrics-addr. Counters are grouped under mu since they're a
+// handful of small maps updated once per attempt, not a hot per-byte path;
+// the gauges shared with startDynamicLimiterImproved are plain atomics.
+type ImprovedMetrics struct {
+	attemptsTotal uint64
+
+	mu               sync.Mutex
+	successByType    map[string]uint64
+	failByType       map[string]uint64
+	successByCountry map[string]uint64
+	latencyBuckets   []uint64 // cumulative counts, parallel to improvedLatencyBucketsSeconds
+	latencyInf       uint64   // +Inf bucket
+	latencySum       float64  // seconds
+	latencyCount     uint64
+
+	dynamicLimit  *int64
+	activeWorkers *uint64
+	memLimitBytes int64
+}
+
+// newImprovedMetrics returns an empty metrics set ready to be passed to
+// testOneImproved/startDynamicLimiterImproved and served via
+// startMetricsServer.
+func newImprovedMetrics() *ImprovedMetrics {
+	return &ImprovedMetrics{
+		successByType:    make(map[string]uint64),
+		failByType:       make(map[string]uint64),
+		successByCountry: make(map[string]uint64),
+		latencyBuckets:   make([]uint64, len(improvedLatencyBucketsSeconds)),
+	}
+}
+
+// RecordAttempt folds one testOneImproved outcome into the counters:
+// total attempts, success/fail by ProxyType, success by Result.Country,
+// and the latency histogram. m may be nil (--metrics-addr not set).
+func (m *ImprovedMetrics) RecordAttempt(proxyType string, success bool, country string, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.attemptsTotal, 1)
+
+	secs := latency.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if success {
+		m.successByType[proxyType]++
+		if country != "" {
+			m.successByCountry[country]++
+		}
+	} else {
+		m.failByType[proxyType]++
+	}
+	m.latencySum += secs
+	m.latencyCount++
+	for i, ub := range improvedLatencyBucketsSeconds {
+		if secs <= ub {
+			m.latencyBuckets[i]++
+		}
+	}
+	m.latencyInf++
+}
+
+// bindLimiter points the dynamic-limit/active-worker gauges at the same
+// atomics startDynamicLimiterImproved already maintains, so /metrics
+// reflects live values without a second write path.
+func (m *ImprovedMetrics) bindLimiter(dynamicLimit *int64, active *uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dynamicLimit = dynamicLimit
+	m.activeWorkers = active
+}
+
+// SetMemLimit records the effective memory ceiling resolveImprovedMemLimit
+// picked, for the proxychecker_improved_mem_limit_bytes gauge.
+func (m *ImprovedMetrics) SetMemLimit(bytes int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.memLimitBytes = bytes
+}
+
+// render writes the full Prometheus text exposition format body.
+func (m *ImprovedMetrics) render() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_attempts_total Total improved-pipeline test attempts.\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_attempts_total counter\n")
+	fmt.Fprintf(&b, "proxychecker_improved_attempts_total %d\n", atomic.LoadUint64(&m.attemptsTotal))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_success_total Successful attempts by proxy_type.\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_success_total counter\n")
+	for _, k := range sortedKeys(m.successByType) {
+		fmt.Fprintf(&b, "proxychecker_improved_success_total{proxy_type=%q} %d\n", k, m.successByType[k])
+	}
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_fail_total Failed attempts by proxy_type.\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_fail_total counter\n")
+	for _, k := range sortedKeys(m.failByType) {
+		fmt.Fprintf(&b, "proxychecker_improved_fail_total{proxy_type=%q} %d\n", k, m.failByType[k])
+	}
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_success_by_country_total Successful attempts by Result.Country.\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_success_by_country_total counter\n")
+	for _, k := range sortedKeys(m.successByCountry) {
+		fmt.Fprintf(&b, "proxychecker_improved_success_by_country_total{country=%q} %d\n", k, m.successByCountry[k])
+	}
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_dynamic_limit Current value of the improved pipeline's dynamic concurrency limit.\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_dynamic_limit gauge\n")
+	if m.dynamicLimit != nil {
+		fmt.Fprintf(&b, "proxychecker_improved_dynamic_limit %d\n", atomic.LoadInt64(m.dynamicLimit))
+	}
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_active_workers Active improved-pipeline workers.\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_active_workers gauge\n")
+	if m.activeWorkers != nil {
+		fmt.Fprintf(&b, "proxychecker_improved_active_workers %d\n", atomic.LoadUint64(m.activeWorkers))
+	}
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_rss_bytes Process resident memory, or cgroup memory.current when running in a container.\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_rss_bytes gauge\n")
+	fmt.Fprintf(&b, "proxychecker_improved_rss_bytes %d\n", improvedUsedMemBytes())
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_mem_limit_bytes Effective memory ceiling the dynamic limiter is tracking (0=unset).\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_mem_limit_bytes gauge\n")
+	fmt.Fprintf(&b, "proxychecker_improved_mem_limit_bytes %d\n", m.memLimitBytes)
+
+	fmt.Fprintf(&b, "# HELP proxychecker_improved_latency_seconds Proxy test latency.\n")
+	fmt.Fprintf(&b, "# TYPE proxychecker_improved_latency_seconds histogram\n")
+	for i, ub := range improvedLatencyBucketsSeconds {
+		fmt.Fprintf(&b, "proxychecker_improved_latency_seconds_bucket{le=\"%g\"} %d\n", ub, m.latencyBuckets[i])
+	}
+	fmt.Fprintf(&b, "proxychecker_improved_latency_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyInf)
+	fmt.Fprintf(&b, "proxychecker_improved_latency_seconds_sum %g\n", m.latencySum)
+	fmt.Fprintf(&b, "proxychecker_improved_latency_seconds_count %d\n", m.latencyCount)
+
+	return b.String()
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// startMetricsServer serves m.render() as text/plain at /metrics on addr
+// until ctx is canceled, mirroring startAdminServer's lifecycle.
+func startMetricsServer(ctx context.Context, addr string, m *ImprovedMetrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(m.render()))
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("metrics 接口退出: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	return srv
+}
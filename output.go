@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// outputFlushEvery/outputFlushInterval bound how long a Result can sit
+// buffered in a sink before it's made durable: each sink flushes on
+// whichever comes first. This used to be the write loop's problem (a
+// hardcoded 256-line/500ms ticker in main.go); now every OutputWriter owns
+// its own cadence, so e.g. sqliteOutputWriter can wrap a whole batch in one
+// transaction instead of committing a row at a time.
+const (
+	outputFlushEvery    = 256
+	outputFlushInterval = 500 * time.Millisecond
+)
+
+// OutputWriter is the sink every successful Result is written through;
+// -out-format selects which implementation openOutputWriter returns. The
+// write loop in main() only ever calls WriteResult/Flush/Close, so a new
+// format is a matter of adding a case to openOutputWriter plus an
+// implementation below, not touching the write loop itself.
+type OutputWriter interface {
+	WriteResult(r Result) error
+	Flush() error
+	Close() error
+}
+
+// openOutputWriter opens path per format ("legacy"/"json"/"csv"/"sqlite").
+// legacy/json/csv all render one line per Result through resultToLineFormatted
+// and buffer it into a plain file; sqlite instead opens/creates a "results"
+// table and inserts one row per success.
+func openOutputWriter(path, format string) (OutputWriter, error) {
+	if format == outFormatSQLite {
+		return openSQLiteOutputWriter(path)
+	}
+	return openLineOutputWriter(path, format)
+}
+
+// lineOutputWriter backs -out-format=legacy/json/csv.
+type lineOutputWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	format string
+
+	mu      sync.Mutex
+	pending int
+	stop    chan struct{}
+}
+
+func openLineOutputWriter(path, format string) (*lineOutputWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	o := &lineOutputWriter{f: f, w: bufio.NewWriterSize(f, 512*1024), format: format, stop: make(chan struct{})}
+	go o.flushLoop()
+	return o, nil
+}
+
+// flushLoop makes outputFlushInterval hold even when results trickle in too
+// slowly to ever hit outputFlushEvery on their own.
+func (o *lineOutputWriter) flushLoop() {
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = o.Flush()
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+func (o *lineOutputWriter) WriteResult(r Result) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err := o.w.WriteString(resultToLineFormatted(r, o.format)); err != nil {
+		return err
+	}
+	o.pending++
+	if o.pending >= outputFlushEvery {
+		err := o.w.Flush()
+		o.pending = 0
+		return err
+	}
+	return nil
+}
+
+func (o *lineOutputWriter) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	err := o.w.Flush()
+	o.pending = 0
+	return err
+}
+
+func (o *lineOutputWriter) Close() error {
+	close(o.stop)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.w.Flush(); err != nil {
+		_ = o.f.Close()
+		return err
+	}
+	return o.f.Close()
+}
+
+// sqliteInsertSQL is re-prepared against each transaction sqliteOutputWriter
+// opens, since a *sql.Stmt from one *sql.Tx can't be reused by the next.
+const sqliteInsertSQL = `INSERT INTO results (
+	addr, type, isp, country, status, tls_ms, ttfb_ms, total_ms, bytes_in, bytes_out,
+	tls_version, tls_cipher, alpn, cert_cn, cert_issuer, cert_self_signed
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+// sqliteOutputWriter backs -out-format=sqlite: successes land one row per
+// Result in a "results" table instead of a line-oriented file, so a scan's
+// output can be queried/joined directly instead of re-parsed. Rows are
+// batched into a single *sql.Tx per outputFlushEvery/outputFlushInterval
+// window instead of auto-committing one INSERT at a time, since modernc.org/
+// sqlite's default journal mode makes a bare-Exec-per-row pattern one
+// fsync-backed commit per proxy at high concurrency.
+type sqliteOutputWriter struct {
+	db *sql.DB
+
+	mu      sync.Mutex
+	tx      *sql.Tx
+	stmt    *sql.Stmt
+	pending int
+	stop    chan struct{}
+}
+
+func openSQLiteOutputWriter(path string) (*sqliteOutputWriter, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite out db %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1) // modernc.org/sqlite serializes writers anyway; avoid "database is locked"
+
+	const schema = `CREATE TABLE IF NOT EXISTS results (
+		addr TEXT NOT NULL,
+		type TEXT NOT NULL,
+		isp TEXT,
+		country TEXT,
+		status INTEGER,
+		tls_ms INTEGER,
+		ttfb_ms INTEGER,
+		total_ms INTEGER,
+		bytes_in INTEGER,
+		bytes_out INTEGER,
+		tls_version TEXT,
+		tls_cipher TEXT,
+		alpn TEXT,
+		cert_cn TEXT,
+		cert_issuer TEXT,
+		cert_self_signed INTEGER
+	)`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init sqlite out db %s: %w", path, err)
+	}
+
+	o := &sqliteOutputWriter{db: db, stop: make(chan struct{})}
+	go o.flushLoop()
+	return o, nil
+}
+
+// flushLoop makes outputFlushInterval hold even when results trickle in too
+// slowly to ever hit outputFlushEvery on their own, so a pending transaction
+// doesn't sit open (and uncommitted) indefinitely.
+func (o *sqliteOutputWriter) flushLoop() {
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = o.Flush()
+		case <-o.stop:
+			return
+		}
+	}
+}
+
+// beginLocked opens o.tx/o.stmt if no transaction is currently open. Caller
+// must hold o.mu.
+func (o *sqliteOutputWriter) beginLocked() error {
+	if o.tx != nil {
+		return nil
+	}
+	tx, err := o.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin sqlite tx: %w", err)
+	}
+	stmt, err := tx.Prepare(sqliteInsertSQL)
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("prepare sqlite insert: %w", err)
+	}
+	o.tx, o.stmt = tx, stmt
+	return nil
+}
+
+// commitLocked commits the open transaction, if any. Caller must hold o.mu.
+func (o *sqliteOutputWriter) commitLocked() error {
+	if o.tx == nil {
+		return nil
+	}
+	_ = o.stmt.Close()
+	err := o.tx.Commit()
+	o.tx, o.stmt, o.pending = nil, nil, 0
+	return err
+}
+
+func (o *sqliteOutputWriter) WriteResult(r Result) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.beginLocked(); err != nil {
+		return err
+	}
+	if _, err := o.stmt.Exec(
+		r.ProxyAddr, strings.ToLower(r.ProxyType), r.ISP, r.Country, r.StatusCode,
+		r.TLSMs, r.TTFBMs, r.TotalMs, r.BytesIn, r.BytesOut,
+		r.TLSVersion, r.TLSCipher, r.ALPN, r.CertCN, r.CertIssuer, r.CertSelfSigned,
+	); err != nil {
+		return err
+	}
+	o.pending++
+	if o.pending >= outputFlushEvery {
+		return o.commitLocked()
+	}
+	return nil
+}
+
+// Flush commits whatever's pending in the open transaction, if any.
+func (o *sqliteOutputWriter) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.commitLocked()
+}
+
+func (o *sqliteOutputWriter) Close() error {
+	close(o.stop)
+	o.mu.Lock()
+	err := o.commitLocked()
+	o.mu.Unlock()
+	if err != nil {
+		_ = o.db.Close()
+		return err
+	}
+	return o.db.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// probeModeChain/Quorum are the -probe-mode values. chain (the default)
+// keeps the pre-existing IPInfoChain.Fetch fallback-on-failure behavior;
+// quorum switches to QuorumProber below.
+const (
+	probeModeChain  = "chain"
+	probeModeQuorum = "quorum"
+)
+
+// QuorumProber fires -probe-parallel ipinfo requests through the same
+// proxied client at once and accepts the first exit IP that -probe-quorum
+// distinct providers agree on, canceling the rest. A proxy that injects a
+// fake ipinfo response for one provider but not another shows up as
+// disagreement instead of silently passing — recorded as the "hijacked"
+// failure class, distinct from an ordinary provider-down failure.
+type QuorumProber struct {
+	providers []IPInfoProvider
+	quorum    int
+	parallel  int
+}
+
+// newQuorumProber builds a prober from providers in -probe-urls order.
+// quorum<=0 is treated as 1; parallel<=0 (or > len(providers)) uses every
+// provider.
+func newQuorumProber(providers []IPInfoProvider, quorum, parallel int) *QuorumProber {
+	if quorum <= 0 {
+		quorum = 1
+	}
+	if parallel <= 0 || parallel > len(providers) {
+		parallel = len(providers)
+	}
+	if quorum > parallel {
+		quorum = parallel
+	}
+	return &QuorumProber{providers: providers, quorum: quorum, parallel: parallel}
+}
+
+type quorumResult struct {
+	info IPInfo
+	err  error
+}
+
+// Fetch mirrors IPInfoChain.Fetch's signature so callers can switch between
+// the two via -probe-mode without touching the call sites.
+func (q *QuorumProber) Fetch(ctx context.Context, client *http.Client, proxyHost string) (IPInfo, error) {
+	if len(q.providers) == 0 {
+		return IPInfo{}, fmt.Errorf("no quorum providers configured")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 收敛前未返回的探测视为输家，随 ctx 取消一并中止
+
+	ch := make(chan quorumResult, q.parallel)
+	for _, p := range q.providers[:q.parallel] {
+		p := p
+		go func() {
+			info, err := p.Lookup(ctx, client, proxyHost)
+			if err != nil {
+				ch <- quorumResult{err: fmt.Errorf("%s: %w", p.Name(), err)}
+				return
+			}
+			ch <- quorumResult{info: info}
+		}()
+	}
+
+	byIP := make(map[string]IPInfo)
+	counts := make(map[string]int)
+	var lastErr error
+	for i := 0; i < q.parallel; i++ {
+		r := <-ch
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if r.info.IP == "" {
+			lastErr = fmt.Errorf("%s: response missing ip", r.info.Provider)
+			continue
+		}
+		if _, ok := byIP[r.info.IP]; !ok {
+			byIP[r.info.IP] = r.info
+		}
+		counts[r.info.IP]++
+		if counts[r.info.IP] >= q.quorum {
+			return byIP[r.info.IP], nil
+		}
+	}
+
+	if len(counts) > 1 {
+		return IPInfo{}, fmt.Errorf("hijacked: quorum providers disagree on exit ip: %v", counts)
+	}
+	if lastErr != nil {
+		return IPInfo{}, fmt.Errorf("quorum probe failed: %w", lastErr)
+	}
+	return IPInfo{}, fmt.Errorf("quorum probe: no provider reached quorum=%d", q.quorum)
+}
+
+// buildQuorumProviders parses the comma-separated -probe-urls value. Each
+// token is either a name from ipInfoRegistry (e.g. "ip-api.com") or a bare
+// URL, in which case it's probed as a generic httpJSONProvider that looks
+// for the exit IP under the common "ip"/"query" JSON keys.
+func buildQuorumProviders(spec string) ([]IPInfoProvider, error) {
+	var providers []IPInfoProvider
+	for _, tok := range strings.Split(spec, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+		if factory, ok := ipInfoRegistry[strings.ToLower(tok)]; ok {
+			providers = append(providers, factory())
+			continue
+		}
+		if !strings.Contains(tok, "://") {
+			return nil, fmt.Errorf("-probe-urls: unknown provider name %q (not a known provider and not a URL)", tok)
+		}
+		providers = append(providers, &httpJSONProvider{name: tok, url: tok, parse: parseGenericIP})
+	}
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("-probe-urls: no providers configured")
+	}
+	return providers, nil
+}
+
+// genericIPResp covers the handful of field names real-world ipinfo-style
+// APIs use for the exit IP, for -probe-urls entries that aren't in
+// ipInfoRegistry.
+type genericIPResp struct {
+	IP    string `json:"ip"`
+	Query string `json:"query"`
+	IPv4  string `json:"ipv4"`
+}
+
+func parseGenericIP(body []byte) (IPInfo, error) {
+	var r genericIPResp
+	if err := json.Unmarshal(body, &r); err != nil {
+		return IPInfo{}, fmt.Errorf("json parse failed: %v", err)
+	}
+	ip := nonEmpty(r.IP, nonEmpty(r.Query, r.IPv4))
+	if ip == "" {
+		return IPInfo{}, fmt.Errorf("invalid response: missing ip")
+	}
+	return IPInfo{IP: ip}, nil
+}
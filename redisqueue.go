@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -redis-role values.
+const (
+	redisRoleCoordinator = "coordinator"
+	redisRoleWorker      = "worker"
+)
+
+// -redis-addr key layout. One checker process can be the coordinator (runs
+// the usual -ip-file scan loop but LPUSHes Jobs instead of feeding a local
+// worker pool) or a worker (BRPOPs jobs, runs them through the existing
+// worker() goroutine, RPUSHes Outcomes back). Both roles share one Redis
+// instance, so the keys are fixed rather than user-configurable.
+const (
+	redisJobsKey        = "proxychecker:jobs"
+	redisResultsKey     = "proxychecker:results"
+	redisNodesKey       = "proxychecker:nodes" // sorted set, score = last heartbeat unix time
+	redisStatsKeyPrefix = "proxychecker:stats:"
+
+	redisNodeTTL        = 15 * time.Second
+	redisHeartbeatEvery = 5 * time.Second
+)
+
+// RedisQueue wraps the go-redis client with the handful of operations the
+// coordinator/worker roles need: nothing here is proxy-checker specific
+// beyond the JSON wire shapes of Job/Outcome.
+type RedisQueue struct {
+	rdb *redis.Client
+}
+
+func openRedisQueue(addr string) (*RedisQueue, error) {
+	rdb := redis.NewClient(&redis.Options{Addr: addr})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("connect redis %s: %w", addr, err)
+	}
+	return &RedisQueue{rdb: rdb}, nil
+}
+
+func (q *RedisQueue) Close() error { return q.rdb.Close() }
+
+// PushJob is the coordinator-side enqueue: normalized Jobs go in, in input
+// order (LPUSH + BRPOP makes the list FIFO).
+func (q *RedisQueue) PushJob(ctx context.Context, job Job) error {
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.rdb.LPush(ctx, redisJobsKey, buf).Err()
+}
+
+// PopJob blocks up to timeout for the next job. A nil, nil return means the
+// wait timed out with nothing queued.
+func (q *RedisQueue) PopJob(ctx context.Context, timeout time.Duration) (*Job, error) {
+	res, err := q.rdb.BRPop(ctx, timeout, redisJobsKey).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal([]byte(res[1]), &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// RequeueJob puts a job back for another worker to pick up: used when this
+// node's hash ring says a popped job's shard belongs to a different node.
+func (q *RedisQueue) RequeueJob(ctx context.Context, job Job) error {
+	return q.PushJob(ctx, job)
+}
+
+// outcomeWire is Outcome's JSON wire shape: error isn't marshalable, so
+// FailErr becomes a plain string (only ever logged/counted on the
+// coordinator side, never type-switched on).
+type outcomeWire struct {
+	ProxyAddr string        `json:"addr"`
+	Successes []Result      `json:"successes,omitempty"`
+	FailErr   string        `json:"fail_err,omitempty"`
+	FailWhy   string        `json:"fail_why,omitempty"`
+	Elapsed   time.Duration `json:"elapsed"`
+}
+
+func (q *RedisQueue) PushOutcome(ctx context.Context, oc Outcome) error {
+	w := outcomeWire{ProxyAddr: oc.ProxyAddr, Successes: oc.Successes, FailWhy: oc.FailWhy, Elapsed: oc.Elapsed}
+	if oc.FailErr != nil {
+		w.FailErr = oc.FailErr.Error()
+	}
+	buf, err := json.Marshal(w)
+	if err != nil {
+		return err
+	}
+	return q.rdb.LPush(ctx, redisResultsKey, buf).Err()
+}
+
+func (q *RedisQueue) PopOutcome(ctx context.Context, timeout time.Duration) (*Outcome, error) {
+	res, err := q.rdb.BRPop(ctx, timeout, redisResultsKey).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var w outcomeWire
+	if err := json.Unmarshal([]byte(res[1]), &w); err != nil {
+		return nil, err
+	}
+	oc := Outcome{ProxyAddr: w.ProxyAddr, Successes: w.Successes, FailWhy: w.FailWhy, Elapsed: w.Elapsed}
+	if w.FailErr != "" {
+		oc.FailErr = fmt.Errorf("%s", w.FailErr)
+	}
+	return &oc, nil
+}
+
+// runRedisJobFeeder is the -redis-role=worker job source: it keeps ring in
+// sync with the live Redis node registry, BRPOPs jobs, and either hands a
+// job to the local worker pool (via jobs) when this node's ring arc owns
+// its shard key, or pushes it back onto the queue for whichever node does.
+// It closes jobs (which stops the local worker pool, same as the local
+// ip-file scan running dry) once the queue has sat empty for idleShutdown —
+// this tool is a batch job, not a long-running daemon, so "queue empty for
+// a while" is the signal that the coordinator finished dispatching.
+func runRedisJobFeeder(ctx context.Context, rq *RedisQueue, jobs chan<- Job, ring *hashRing, nodeID string, idleShutdown time.Duration) {
+	defer close(jobs)
+	var idleSince time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if nodes, err := rq.ListNodes(ctx); err == nil {
+			ring.Sync(nodes)
+		}
+
+		job, err := rq.PopJob(ctx, 3*time.Second)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			time.Sleep(time.Second)
+			continue
+		}
+		if job == nil {
+			if idleSince.IsZero() {
+				idleSince = time.Now()
+			} else if time.Since(idleSince) >= idleShutdown {
+				return
+			}
+			continue
+		}
+		idleSince = time.Time{}
+
+		if owner, ok := ring.Owner(shardKey(job.ProxyAddr)); ok && owner != nodeID {
+			_ = rq.RequeueJob(ctx, *job)
+			continue
+		}
+		jobs <- *job
+	}
+}
+
+// Heartbeat registers nodeID as live until the next call (or redisNodeTTL
+// elapses without one): ZADD with the current unix time as score, so
+// ListNodes can cheaply evict anyone whose score has gone stale instead of
+// needing a separate expiry mechanism per member.
+func (q *RedisQueue) Heartbeat(ctx context.Context, nodeID string) error {
+	return q.rdb.ZAdd(ctx, redisNodesKey, redis.Z{Score: float64(time.Now().Unix()), Member: nodeID}).Err()
+}
+
+// ListNodes returns the node ids that have heartbeat within redisNodeTTL,
+// first evicting anyone older than that from the registry.
+func (q *RedisQueue) ListNodes(ctx context.Context) ([]string, error) {
+	cutoff := float64(time.Now().Add(-redisNodeTTL).Unix())
+	if err := q.rdb.ZRemRangeByScore(ctx, redisNodesKey, "-inf", fmt.Sprintf("(%f", cutoff)).Err(); err != nil {
+		return nil, err
+	}
+	return q.rdb.ZRange(ctx, redisNodesKey, 0, -1).Result()
+}
+
+// PublishStats writes this node's current atomic counters to its own Redis
+// hash so a coordinator's progress printer can sum across the whole fleet
+// instead of only seeing its own (empty, in worker mode) counters.
+func (q *RedisQueue) PublishStats(ctx context.Context, nodeID string, stats map[string]uint64) error {
+	fields := make(map[string]interface{}, len(stats))
+	for k, v := range stats {
+		fields[k] = v
+	}
+	key := redisStatsKeyPrefix + nodeID
+	pipe := q.rdb.TxPipeline()
+	pipe.HSet(ctx, key, fields)
+	pipe.Expire(ctx, key, redisNodeTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// AggregateStats sums the published per-node stats hashes of every live
+// node into one totals map (keys: done/okIP/fail/skip/activeW/dynLim).
+func (q *RedisQueue) AggregateStats(ctx context.Context) (map[string]uint64, error) {
+	nodes, err := q.ListNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[string]uint64)
+	for _, id := range nodes {
+		vals, err := q.rdb.HGetAll(ctx, redisStatsKeyPrefix+id).Result()
+		if err != nil {
+			continue
+		}
+		for k, v := range vals {
+			var n uint64
+			_, _ = fmt.Sscanf(v, "%d", &n)
+			totals[k] += n
+		}
+	}
+	return totals, nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== 自定义 DNS 解析器 (-resolver) ==========
+//
+// HostResolver replaces the OS resolver used by dialWithIPPreference (shared
+// by testHTTPProxy/testHTTPSProxy/testSocks5Proxy's base dialer) when
+// -resolver is set, so scanning a hostname list doesn't leak every target to
+// the local/ISP DNS. It speaks DoH, DoT, or plain UDP depending on scheme,
+// and caches answers (bounded, respecting TTL) so a hostname repeated across
+// ports/auth combos on the same input line only hits the wire once.
+type HostResolver struct {
+	backend resolverBackend
+	cache   *dnsCache
+}
+
+// resolverBackend performs the actual A/AAAA lookup over the wire.
+type resolverBackend interface {
+	lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+// dnsCacheCapacity bounds the resolver's in-memory cache; large enough for
+// a single scan's worth of distinct proxy hostnames without growing
+// unbounded on a multi-million-line list.
+const dnsCacheCapacity = 4096
+
+const dnsBackendTimeout = 5 * time.Second
+
+// newHostResolver parses spec (e.g. "doh://cloudflare-dns.com/dns-query",
+// "udp://1.1.1.1:53", "dot://dns.google:853") into a HostResolver. Only
+// called when -resolver is non-empty.
+func newHostResolver(spec string) (*HostResolver, error) {
+	scheme, rest, ok := strings.Cut(spec, "://")
+	if !ok || rest == "" {
+		return nil, fmt.Errorf("-resolver=%q: want scheme://host[:port][/path], scheme is doh/udp/dot", spec)
+	}
+	rest = strings.TrimSuffix(rest, "/")
+
+	var backend resolverBackend
+	switch strings.ToLower(scheme) {
+	case "doh":
+		backend = &dohBackend{endpoint: "https://" + rest, client: &http.Client{Timeout: dnsBackendTimeout}}
+	case "udp":
+		addr, err := hostPortWithDefault(rest, "53")
+		if err != nil {
+			return nil, fmt.Errorf("-resolver=%q: %w", spec, err)
+		}
+		backend = &wireBackend{network: "udp", addr: addr}
+	case "dot":
+		addr, err := hostPortWithDefault(rest, "853")
+		if err != nil {
+			return nil, fmt.Errorf("-resolver=%q: %w", spec, err)
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		backend = &wireBackend{network: "tcp", addr: addr, tlsServerName: host}
+	default:
+		return nil, fmt.Errorf("-resolver=%q: unknown scheme %q, want doh/udp/dot", spec, scheme)
+	}
+
+	return &HostResolver{backend: backend, cache: newDNSCache(dnsCacheCapacity)}, nil
+}
+
+// hostPortWithDefault appends defPort to hostport if it doesn't already
+// carry one.
+func hostPortWithDefault(hostport, defPort string) (string, error) {
+	if strings.TrimSpace(hostport) == "" {
+		return "", fmt.Errorf("empty resolver address")
+	}
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport, nil
+	}
+	return net.JoinHostPort(hostport, defPort), nil
+}
+
+// LookupIPAddr resolves host (not already an IP literal) to its A/AAAA
+// records, serving from cache when a fresh entry exists.
+func (r *HostResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.cache.get(host); ok {
+		return addrs, nil
+	}
+	addrs, ttl, err := r.backend.lookup(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolver: %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolver: no A/AAAA records for %s", host)
+	}
+	r.cache.set(host, addrs, ttl)
+	return addrs, nil
+}
+
+// ---------- 缓存 ----------
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+// dnsCache is a bounded LRU keyed by hostname; entries also expire on the
+// resolver-reported TTL so a short-lived record doesn't linger for the rest
+// of a long scan.
+type dnsCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    []string
+	entries  map[string]dnsCacheEntry
+}
+
+func newDNSCache(capacity int) *dnsCache {
+	return &dnsCache{capacity: capacity, entries: make(map[string]dnsCacheEntry)}
+}
+
+func (c *dnsCache) get(host string) ([]net.IPAddr, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	c.touch(host)
+	return e.addrs, true
+}
+
+func (c *dnsCache) set(host string, addrs []net.IPAddr, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[host]; !exists {
+		if len(c.order) >= c.capacity {
+			oldest := c.order[0]
+			c.order = c.order[1:]
+			delete(c.entries, oldest)
+		}
+		c.order = append(c.order, host)
+	} else {
+		c.touch(host)
+	}
+	c.entries[host] = dnsCacheEntry{addrs: addrs, expires: time.Now().Add(ttl)}
+}
+
+// touch moves host to the back of the eviction order; caller holds c.mu.
+func (c *dnsCache) touch(host string) {
+	for i, h := range c.order {
+		if h == host {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, host)
+}
+
+// ---------- 后端：plain UDP / DoT ----------
+
+// wireBackend speaks raw DNS wire format over a plain UDP socket or a
+// TLS-wrapped TCP connection (DoT), querying A and AAAA concurrently.
+type wireBackend struct {
+	network       string // "udp" or "tcp"
+	addr          string
+	tlsServerName string // non-empty selects DoT (TLS over the TCP conn)
+}
+
+func (b *wireBackend) lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return concurrentAAndAAAA(ctx, host, b.queryOne)
+}
+
+func (b *wireBackend) queryOne(ctx context.Context, host string, qtype uint16) ([]net.IPAddr, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsBackendTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, b.network, b.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	if b.tlsServerName != "" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: b.tlsServerName})
+		if dl, ok := ctx.Deadline(); ok {
+			_ = tlsConn.SetDeadline(dl)
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, 0, err
+		}
+		conn = tlsConn
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+
+	query, err := encodeDNSQuery(uint16(rand.Intn(1<<16)), host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if b.network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, 0, err
+		}
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		return decodeDNSAnswer(buf[:n])
+	}
+
+	// TCP/DoT 消息前面有 2 字节大端长度前缀。
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, 0, err
+	}
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, 0, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, 0, err
+	}
+	return decodeDNSAnswer(resp)
+}
+
+// ---------- 后端：DoH ----------
+
+// dohBackend speaks RFC 8484 DNS-over-HTTPS (POST, application/dns-message).
+type dohBackend struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (b *dohBackend) lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	return concurrentAAndAAAA(ctx, host, b.queryOne)
+}
+
+func (b *dohBackend) queryOne(ctx context.Context, host string, qtype uint16) ([]net.IPAddr, time.Duration, error) {
+	query, err := encodeDNSQuery(uint16(rand.Intn(1<<16)), host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("doh: unexpected status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, 0, err
+	}
+	return decodeDNSAnswer(body)
+}
+
+// concurrentAAndAAAA runs query for both record types in parallel and
+// merges the results. A host missing one family isn't an error as long as
+// the other query actually answered.
+func concurrentAAndAAAA(ctx context.Context, host string, query func(context.Context, string, uint16) ([]net.IPAddr, time.Duration, error)) ([]net.IPAddr, time.Duration, error) {
+	type outcome struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	resCh := make(chan outcome, 2)
+	for _, qtype := range [...]uint16{dnsTypeA, dnsTypeAAAA} {
+		qtype := qtype
+		go func() {
+			addrs, ttl, err := query(ctx, host, qtype)
+			resCh <- outcome{addrs, ttl, err}
+		}()
+	}
+
+	var addrs []net.IPAddr
+	var minTTL time.Duration
+	var lastErr error
+	oks := 0
+	for i := 0; i < 2; i++ {
+		o := <-resCh
+		if o.err != nil {
+			lastErr = o.err
+			continue
+		}
+		oks++
+		addrs = append(addrs, o.addrs...)
+		if minTTL == 0 || (o.ttl > 0 && o.ttl < minTTL) {
+			minTTL = o.ttl
+		}
+	}
+	if oks == 0 {
+		return nil, 0, lastErr
+	}
+	return addrs, minTTL, nil
+}
+
+// ---------- 最小 DNS 报文编解码（仅 A/AAAA 单问题查询） ----------
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	dnsClassIN  uint16 = 1
+)
+
+// encodeDNSQuery builds a minimal single-question DNS query (recursion
+// desired, no EDNS0).
+func encodeDNSQuery(id uint16, host string, qtype uint16) ([]byte, error) {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, id)
+	buf.Write([]byte{0x01, 0x00})                         // flags: RD=1
+	buf.Write([]byte{0x00, 0x01})                         // qdcount=1
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) // an/ns/arcount=0
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid dns label in %q", host)
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+	_ = binary.Write(&buf, binary.BigEndian, qtype)
+	_ = binary.Write(&buf, binary.BigEndian, dnsClassIN)
+	return buf.Bytes(), nil
+}
+
+// decodeDNSAnswer parses msg's answer section for A/AAAA records, returning
+// the addresses and the minimum TTL seen (0 if there were none).
+func decodeDNSAnswer(msg []byte) ([]net.IPAddr, time.Duration, error) {
+	if len(msg) < 12 {
+		return nil, 0, fmt.Errorf("dns: short message")
+	}
+	rcode := msg[3] & 0x0F
+	if rcode != 0 {
+		return nil, 0, fmt.Errorf("dns: rcode=%d", rcode)
+	}
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	ancount := binary.BigEndian.Uint16(msg[6:8])
+
+	off := 12
+	for i := 0; i < int(qdcount); i++ {
+		var err error
+		off, err = skipDNSName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off += 4 // qtype + qclass
+	}
+
+	var addrs []net.IPAddr
+	var minTTL time.Duration = -1
+	for i := 0; i < int(ancount); i++ {
+		var err error
+		off, err = skipDNSName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, fmt.Errorf("dns: truncated answer")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off : off+2])
+		ttl := binary.BigEndian.Uint32(msg[off+4 : off+8])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, fmt.Errorf("dns: truncated rdata")
+		}
+		rdata := msg[off : off+rdlen]
+		off += rdlen
+
+		switch rtype {
+		case dnsTypeA:
+			if len(rdata) == 4 {
+				addrs = append(addrs, net.IPAddr{IP: net.IP(append([]byte{}, rdata...))})
+			}
+		case dnsTypeAAAA:
+			if len(rdata) == 16 {
+				addrs = append(addrs, net.IPAddr{IP: net.IP(append([]byte{}, rdata...))})
+			}
+		default:
+			continue
+		}
+		t := time.Duration(ttl) * time.Second
+		if minTTL < 0 || t < minTTL {
+			minTTL = t
+		}
+	}
+	if minTTL < 0 {
+		minTTL = 0
+	}
+	return addrs, minTTL, nil
+}
+
+// skipDNSName advances past a (possibly compressed) name starting at off,
+// returning the offset just past it. We only ever need to skip names (the
+// echoed question, compressed owner names in answers), never resolve them.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, fmt.Errorf("dns: name runs past end of message")
+		}
+		b := msg[off]
+		switch {
+		case b == 0:
+			return off + 1, nil
+		case b&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return 0, fmt.Errorf("dns: truncated compression pointer")
+			}
+			return off + 2, nil
+		default:
+			off += int(b) + 1
+		}
+	}
+}
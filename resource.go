@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot is a point-in-time view of host resource headroom, used to size
+// the worker pool so it behaves on a 2GB VPS the same way it does on a
+// 128GB workstation.
+type Snapshot struct {
+	TotalMem int64  // 物理内存总量（字节），0=未知
+	AvailMem int64  // 可用物理内存（字节），0=未知
+	FDLimit  uint64 // 进程可用的文件描述符上限
+	FDInUse  uint64 // 当前已使用的文件描述符数
+}
+
+// ResourceMonitor periodically samples memory and FD headroom and fans the
+// result out to subscribers (e.g. the dynamic concurrency limiter).
+type ResourceMonitor struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	subs []chan Snapshot
+
+	last atomic.Value // Snapshot
+
+	stop chan struct{}
+}
+
+func newResourceMonitor(interval time.Duration) *ResourceMonitor {
+	if interval <= 0 {
+		interval = 3 * time.Second
+	}
+	m := &ResourceMonitor{interval: interval, stop: make(chan struct{})}
+	m.last.Store(m.sample())
+	return m
+}
+
+// Snapshot returns the most recently sampled resource snapshot.
+func (m *ResourceMonitor) Snapshot() Snapshot {
+	if v := m.last.Load(); v != nil {
+		return v.(Snapshot)
+	}
+	return Snapshot{}
+}
+
+// Subscribe registers ch to receive every new Snapshot. Sends are
+// best-effort: a slow/full subscriber just misses a tick.
+func (m *ResourceMonitor) Subscribe(ch chan Snapshot) {
+	m.mu.Lock()
+	m.subs = append(m.subs, ch)
+	m.mu.Unlock()
+}
+
+// Start begins the sampling loop in a background goroutine.
+func (m *ResourceMonitor) Start() {
+	go func() {
+		t := time.NewTicker(m.interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-t.C:
+				snap := m.sample()
+				m.last.Store(snap)
+
+				m.mu.Lock()
+				subs := m.subs
+				m.mu.Unlock()
+				for _, ch := range subs {
+					select {
+					case ch <- snap:
+					default:
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (m *ResourceMonitor) Close() {
+	close(m.stop)
+}
+
+func (m *ResourceMonitor) sample() Snapshot {
+	total, avail := detectMemHeadroom()
+	fdLimit := detectFDLimit()
+	fdInUse := detectFDInUse()
+	return Snapshot{TotalMem: total, AvailMem: avail, FDLimit: fdLimit, FDInUse: fdInUse}
+}
@@ -0,0 +1,54 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// detectMemHeadroom returns (total, available) physical memory in bytes as
+// reported by /proc/meminfo. Either value may be 0 if undetectable.
+func detectMemHeadroom() (total int64, avail int64) {
+	b, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	for _, ln := range strings.Split(string(b), "\n") {
+		switch {
+		case strings.HasPrefix(ln, "MemTotal:"):
+			if kb, ok := parseMeminfoKB(ln); ok {
+				total = kb * 1024
+			}
+		case strings.HasPrefix(ln, "MemAvailable:"):
+			if kb, ok := parseMeminfoKB(ln); ok {
+				avail = kb * 1024
+			}
+		}
+	}
+	return total, avail
+}
+
+func parseMeminfoKB(ln string) (int64, bool) {
+	f := strings.Fields(ln)
+	if len(f) < 2 {
+		return 0, false
+	}
+	v, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+// detectFDInUse counts the open file descriptors of the current process via
+// /proc/self/fd. Returns 0 if unavailable (e.g. non-Linux unix).
+func detectFDInUse() uint64 {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	return uint64(len(entries))
+}
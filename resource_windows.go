@@ -0,0 +1,56 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// detectMemHeadroom returns (total, available) physical memory in bytes via
+// GlobalMemoryStatusEx.
+func detectMemHeadroom() (total int64, avail int64) {
+	type memoryStatusEx struct {
+		cbSize                  uint32
+		dwMemoryLoad            uint32
+		ullTotalPhys            uint64
+		ullAvailPhys            uint64
+		ullTotalPageFile        uint64
+		ullAvailPageFile        uint64
+		ullTotalVirtual         uint64
+		ullAvailVirtual         uint64
+		ullAvailExtendedVirtual uint64
+	}
+
+	var m memoryStatusEx
+	m.cbSize = uint32(unsafe.Sizeof(m))
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	gmse := kernel32.NewProc("GlobalMemoryStatusEx")
+	if gmse.Find() != nil {
+		return 0, 0
+	}
+	r1, _, _ := gmse.Call(uintptr(unsafe.Pointer(&m)))
+	if r1 == 0 {
+		return 0, 0
+	}
+	return int64(m.ullTotalPhys), int64(m.ullAvailPhys)
+}
+
+// detectFDInUse returns the number of open handles for the current process
+// via GetProcessHandleCount.
+func detectFDInUse() uint64 {
+	kernel32 := syscall.NewLazyDLL("kernel32.dll")
+	gphc := kernel32.NewProc("GetProcessHandleCount")
+	if gphc.Find() != nil {
+		return 0
+	}
+	curProc, _, _ := kernel32.NewProc("GetCurrentProcess").Call()
+
+	var count uint32
+	r1, _, _ := gphc.Call(curProc, uintptr(unsafe.Pointer(&count)))
+	if r1 == 0 {
+		return 0
+	}
+	return uint64(count)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "time"
+
+// TuneOptions controls which socket options Tune applies to a raw fd. Zero
+// values mean "leave the OS default alone" except where noted.
+type TuneOptions struct {
+	Linger bool // SO_LINGER{onoff=1, linger=0}: drop TIME_WAIT on close
+
+	KeepAlive     bool
+	KeepIdle      time.Duration // TCP_KEEPIDLE / SIO_KEEPALIVE_VALS
+	KeepInterval  time.Duration // TCP_KEEPINTVL / SIO_KEEPALIVE_VALS
+	KeepCount     int           // TCP_KEEPCNT (unix only)
+
+	UserTimeout time.Duration // TCP_USER_TIMEOUT (linux only)
+
+	BindAddressNoPort bool // IP_BIND_ADDRESS_NO_PORT (linux only)
+
+	ReuseAddr bool // SO_REUSEADDR
+	ReusePort bool // SO_REUSEPORT (unix only)
+}
+
+// defaultTuneOptions mirrors the checker's historical behavior: drop
+// TIME_WAIT aggressively, nothing else.
+func defaultTuneOptions() TuneOptions {
+	return TuneOptions{Linger: true}
+}
@@ -0,0 +1,38 @@
+//go:build darwin || freebsd || netbsd || openbsd || dragonfly
+// +build darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func setReusePort(fd int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+// setTCPKeepIdle uses TCP_KEEPALIVE, the BSD/Darwin equivalent of Linux's
+// TCP_KEEPIDLE.
+func setTCPKeepIdle(fd int, d time.Duration) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPALIVE, int(d.Seconds()))
+}
+
+func setTCPKeepIntvl(fd int, d time.Duration) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(d.Seconds()))
+}
+
+func setTCPKeepCnt(fd int, n int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, n)
+}
+
+// setTCPUserTimeout has no BSD/Darwin equivalent; treated as a no-op.
+func setTCPUserTimeout(fd int, d time.Duration) error {
+	return nil
+}
+
+// setBindAddressNoPort is Linux-specific; treated as a no-op elsewhere.
+func setBindAddressNoPort(fd int) error {
+	return nil
+}
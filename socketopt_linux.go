@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func setReusePort(fd int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+func setTCPKeepIdle(fd int, d time.Duration) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, int(d.Seconds()))
+}
+
+func setTCPKeepIntvl(fd int, d time.Duration) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, int(d.Seconds()))
+}
+
+func setTCPKeepCnt(fd int, n int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, n)
+}
+
+// setTCPUserTimeout bounds how long unacked data may sit before the kernel
+// gives up on the connection, independent of the retransmit count — this is
+// what actually kills half-open sockets fast during mass proxy scans.
+func setTCPUserTimeout(fd int, d time.Duration) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(d.Milliseconds()))
+}
+
+// setBindAddressNoPort avoids reserving an ephemeral source port until
+// connect() actually needs one, reducing TIME_WAIT/port exhaustion under
+// very high concurrent outbound connect rates.
+func setBindAddressNoPort(fd int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_BIND_ADDRESS_NO_PORT, 1)
+}
@@ -0,0 +1,62 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Tune applies TuneOptions to a raw socket fd on unix. Best-effort: it keeps
+// going and returns the first error encountered, if any, so callers can log
+// without aborting the dial.
+func Tune(fd uintptr, opts TuneOptions) error {
+	var firstErr error
+	setErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	ifd := int(fd)
+
+	if opts.Linger {
+		setErr(unix.SetsockoptLinger(ifd, unix.SOL_SOCKET, unix.SO_LINGER, &unix.Linger{Onoff: 1, Linger: 0}))
+	}
+
+	if opts.ReuseAddr {
+		setErr(unix.SetsockoptInt(ifd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1))
+	}
+	if opts.ReusePort {
+		setErr(setReusePort(ifd))
+	}
+
+	if opts.KeepAlive {
+		setErr(unix.SetsockoptInt(ifd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1))
+		if opts.KeepIdle > 0 {
+			setErr(setTCPKeepIdle(ifd, opts.KeepIdle))
+		}
+		if opts.KeepInterval > 0 {
+			setErr(setTCPKeepIntvl(ifd, opts.KeepInterval))
+		}
+		if opts.KeepCount > 0 {
+			setErr(setTCPKeepCnt(ifd, opts.KeepCount))
+		}
+	}
+
+	if opts.UserTimeout > 0 {
+		setErr(setTCPUserTimeout(ifd, opts.UserTimeout))
+	}
+
+	if opts.BindAddressNoPort {
+		setErr(setBindAddressNoPort(ifd))
+	}
+
+	return firstErr
+}
+
+// setSockLinger is kept for compatibility with the pre-existing call sites;
+// it is equivalent to Tune(fd, TuneOptions{Linger: true}).
+func setSockLinger(fd uintptr) error {
+	return unix.SetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER, &unix.Linger{Onoff: 1, Linger: 0})
+}
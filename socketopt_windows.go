@@ -0,0 +1,62 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Tune applies TuneOptions to a raw socket handle on Windows. Best-effort:
+// it keeps going and returns the first error encountered, if any.
+func Tune(fd uintptr, opts TuneOptions) error {
+	var firstErr error
+	setErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	h := syscall.Handle(fd)
+
+	if opts.Linger {
+		setErr(setSockLinger(fd))
+	}
+
+	if opts.ReuseAddr {
+		setErr(syscall.SetsockoptInt(h, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1))
+	}
+
+	if opts.KeepAlive && (opts.KeepIdle > 0 || opts.KeepInterval > 0) {
+		setErr(setKeepAliveVals(h, opts.KeepIdle, opts.KeepInterval))
+	}
+
+	// TCP_USER_TIMEOUT, SO_REUSEPORT and IP_BIND_ADDRESS_NO_PORT have no
+	// Windows equivalent; silently ignored.
+	return firstErr
+}
+
+// tcpKeepAlive mirrors the layout expected by WSAIoctl's SIO_KEEPALIVE_VALS.
+type tcpKeepAlive struct {
+	OnOff         uint32
+	KeepAliveTime uint32
+	KeepAliveIntv uint32
+}
+
+const sioKeepAliveVals = syscall.IOC_IN | syscall.IOC_WS2 | 4
+
+func setKeepAliveVals(h syscall.Handle, idle, interval time.Duration) error {
+	in := tcpKeepAlive{
+		OnOff:         1,
+		KeepAliveTime: uint32(idle.Milliseconds()),
+		KeepAliveIntv: uint32(interval.Milliseconds()),
+	}
+	var outBytes uint32
+	return syscall.WSAIoctl(h,
+		sioKeepAliveVals,
+		(*byte)(unsafe.Pointer(&in)), uint32(unsafe.Sizeof(in)),
+		nil, 0,
+		&outBytes, nil, 0)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// proxiesBucket is the single BoltDB bucket used by StateStore: key is the
+// proxy's "host:port", value is a JSON-encoded ProxyState.
+var proxiesBucket = []byte("proxies")
+
+// sourceOffsetsBucket tracks how far a -in source (file:/http:, which can
+// realistically be partway through a large list when a run is interrupted)
+// has been consumed, keyed by InputSource.Name(). Value is a decimal byte
+// offset, not JSON, since it's the only field.
+var sourceOffsetsBucket = []byte("source_offsets")
+
+// proxyStatus is the lifecycle of a single proxy's state row across runs.
+type proxyStatus string
+
+const (
+	statusPending proxyStatus = "pending" // dispatched to a worker, outcome not yet recorded
+	statusGood    proxyStatus = "good"
+	statusBad     proxyStatus = "bad"
+)
+
+// ProxyState is the persisted, per-proxy record merged across runs: how
+// often it has worked, how fast, and what it last failed with. EMALatency
+// uses the same smoothing constant as the progress reporter's ip/s EMA.
+type ProxyState struct {
+	ProxyAddr        string      `json:"addr"`
+	Status           proxyStatus `json:"status"`
+	SuccessCount     uint64      `json:"success_count"`
+	FailCount        uint64      `json:"fail_count"`
+	ConsecutiveFails uint64      `json:"consecutive_fails"`
+	EMALatencyMs     float64     `json:"ema_latency_ms"`
+	LastErrorClass   string      `json:"last_error_class,omitempty"`
+	LastCheckedAt    time.Time   `json:"last_checked_at"`
+}
+
+// StateStore persists ProxyState across runs in a BoltDB file (-state). It
+// is safe for concurrent use by worker goroutines.
+type StateStore struct {
+	db *bolt.DB
+	mu sync.Mutex // serializes read-modify-write of a single row
+}
+
+// openStateStore opens (creating if needed) the BoltDB file at path and
+// ensures the proxies bucket exists.
+func openStateStore(path string) (*StateStore, error) {
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open state db %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(proxiesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(sourceOffsetsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init state db %s: %w", path, err)
+	}
+	return &StateStore{db: db}, nil
+}
+
+func (s *StateStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Get returns the stored state for addr, if any.
+func (s *StateStore) Get(addr string) (ProxyState, bool) {
+	var st ProxyState
+	found := false
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(proxiesBucket)
+		v := b.Get([]byte(addr))
+		if v == nil {
+			return nil
+		}
+		if err := json.Unmarshal(v, &st); err != nil {
+			return nil
+		}
+		found = true
+		return nil
+	})
+	return st, found
+}
+
+func (s *StateStore) put(st ProxyState) error {
+	buf, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(proxiesBucket).Put([]byte(st.ProxyAddr), buf)
+	})
+}
+
+// MarkPending records that addr has been dispatched to a worker in this
+// run, so an interrupted run can be resumed with -resume.
+func (s *StateStore) MarkPending(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.Get(addr)
+	if !ok {
+		st = ProxyState{ProxyAddr: addr}
+	}
+	st.Status = statusPending
+	st.LastCheckedAt = time.Now()
+	if err := s.put(st); err != nil {
+		// 状态持久化失败不应该影响本次扫描，只是下次无法从这里 resume
+		_ = err
+	}
+}
+
+// emaAlpha matches the smoothing constant main() uses for its ip/s EMA.
+const emaAlpha = 0.20
+
+// RecordResult merges a job outcome into addr's persisted state.
+func (s *StateStore) RecordResult(addr string, success bool, latency time.Duration, errClass string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.Get(addr)
+	if !ok {
+		st = ProxyState{ProxyAddr: addr}
+	}
+	st.LastCheckedAt = time.Now()
+	if success {
+		st.Status = statusGood
+		st.SuccessCount++
+		st.ConsecutiveFails = 0
+		ms := float64(latency.Milliseconds())
+		if st.EMALatencyMs == 0 {
+			st.EMALatencyMs = ms
+		} else {
+			st.EMALatencyMs = st.EMALatencyMs*(1-emaAlpha) + ms*emaAlpha
+		}
+		st.LastErrorClass = ""
+	} else {
+		st.Status = statusBad
+		st.FailCount++
+		st.ConsecutiveFails++
+		st.LastErrorClass = errClass
+	}
+	if err := s.put(st); err != nil {
+		_ = err
+	}
+}
+
+// ShouldSkip decides whether addr should be skipped this run given its
+// persisted state, -cooldown, -resume and -resume-requeue-after. skipWhy is
+// set (and non-empty) only when skip is true, for skipReasons bookkeeping.
+// requeueAfter, when non-zero, forces a known-good row older than it back
+// into the run even though cooldown_good would otherwise skip it — so a
+// -cooldown tuned for fast re-skip of fresh successes doesn't also hide a
+// proxy that went stale (changed ISP, got reassigned) weeks ago.
+func (s *StateStore) ShouldSkip(addr string, cooldown time.Duration, resume bool, requeueAfter time.Duration) (skip bool, skipWhy string) {
+	st, ok := s.Get(addr)
+	if !ok {
+		if resume {
+			return true, "resume_unseen"
+		}
+		return false, ""
+	}
+
+	if resume {
+		if st.Status != statusPending {
+			return true, "resume_done"
+		}
+		return false, ""
+	}
+
+	since := time.Since(st.LastCheckedAt)
+	switch st.Status {
+	case statusBad:
+		if cooldown > 0 && since < cooldown {
+			return true, "cooldown_bad"
+		}
+	case statusGood:
+		if requeueAfter > 0 && since >= requeueAfter {
+			return false, ""
+		}
+		// 已知可用的代理复测频率降低，按 cooldown 的倍数错开
+		if cooldown > 0 && since < cooldown*6 {
+			return true, "cooldown_good"
+		}
+	}
+	return false, ""
+}
+
+// Compact deletes rows whose LastCheckedAt is older than maxAge, keeping
+// -state from growing unbounded across many runs against large/rotating
+// input lists. It runs once at startup (-state-compact-after), not on a
+// timer, since the DB is only touched between runs.
+func (s *StateStore) Compact(maxAge time.Duration) (removed int, err error) {
+	cutoff := time.Now().Add(-maxAge)
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(proxiesBucket)
+		var stale [][]byte
+		cursorErr := b.ForEach(func(k, v []byte) error {
+			var st ProxyState
+			if jsonErr := json.Unmarshal(v, &st); jsonErr != nil {
+				return nil
+			}
+			if st.Status != statusPending && st.LastCheckedAt.Before(cutoff) {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if cursorErr != nil {
+			return cursorErr
+		}
+		for _, k := range stale {
+			if delErr := b.Delete(k); delErr != nil {
+				return delErr
+			}
+		}
+		removed = len(stale)
+		return nil
+	})
+	return removed, err
+}
+
+// SaveSourceOffset checkpoints how many bytes of a -in source have been
+// consumed, so -resume can re-open it with Range/Seek instead of restarting
+// from byte 0. Called periodically by feedInputSources, not per line.
+func (s *StateStore) SaveSourceOffset(name string, offset int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sourceOffsetsBucket).Put([]byte(name), []byte(strconv.FormatInt(offset, 10)))
+	})
+}
+
+// LoadSourceOffset returns the last checkpointed byte offset for name, or
+// (0, false) if none was recorded (fresh source, or -resume wasn't used last
+// run).
+func (s *StateStore) LoadSourceOffset(name string) (int64, bool) {
+	var offset int64
+	found := false
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(sourceOffsetsBucket).Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil {
+			return nil
+		}
+		offset = n
+		found = true
+		return nil
+	})
+	return offset, found
+}
+
+// Len returns the number of tracked proxy rows.
+func (s *StateStore) Len() int {
+	n := 0
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(proxiesBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// TopSlowest returns the n known-good rows with the highest EMA latency.
+func (s *StateStore) TopSlowest(n int) []ProxyState {
+	all := s.all()
+	sort.Slice(all, func(i, j int) bool { return all[i].EMALatencyMs > all[j].EMALatencyMs })
+	return capStates(all, n)
+}
+
+// TopFailing returns the n rows with the most consecutive failures.
+func (s *StateStore) TopFailing(n int) []ProxyState {
+	all := s.all()
+	sort.Slice(all, func(i, j int) bool { return all[i].ConsecutiveFails > all[j].ConsecutiveFails })
+	return capStates(all, n)
+}
+
+func capStates(all []ProxyState, n int) []ProxyState {
+	if n > len(all) {
+		n = len(all)
+	}
+	return all[:n]
+}
+
+func (s *StateStore) all() []ProxyState {
+	out := make([]ProxyState, 0, s.Len())
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(proxiesBucket)
+		return b.ForEach(func(k, v []byte) error {
+			var st ProxyState
+			if err := json.Unmarshal(v, &st); err != nil {
+				return nil
+			}
+			out = append(out, st)
+			return nil
+		})
+	})
+	return out
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// -out-format values.
+const (
+	outFormatLegacy = "legacy"
+	outFormatJSON   = "json"
+	outFormatCSV    = "csv"
+	outFormatSQLite = "sqlite"
+)
+
+// connTiming aggregates the bandwidth/latency facts -out-format=json/csv
+// exposes for one proxy attempt: bytes moved over every net.Conn the attempt
+// dials (proxy handshake, CONNECT tunnel, the ipinfo request itself), when
+// the TLS handshake to the ipinfo target completed, and when its first
+// response byte arrived. tlsMs/ttfbMs start at -1 ("not observed") since a
+// plain-HTTP attempt never does a target-side TLS handshake and a failed
+// attempt may never get a response byte.
+type connTiming struct {
+	start    time.Time
+	bytesIn  uint64
+	bytesOut uint64
+	tlsMs    int64
+	ttfbMs   int64
+}
+
+func newConnTiming() *connTiming {
+	return &connTiming{start: time.Now(), tlsMs: -1, ttfbMs: -1}
+}
+
+func (t *connTiming) addIn(n int)  { atomic.AddUint64(&t.bytesIn, uint64(n)) }
+func (t *connTiming) addOut(n int) { atomic.AddUint64(&t.bytesOut, uint64(n)) }
+
+// withTrace attaches an httptrace.ClientTrace to ctx that latches tlsMs and
+// ttfbMs the first time each fires (an IPInfoChain can retry providers, and
+// we want this attempt's earliest numbers, not the last provider tried).
+func (t *connTiming) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				atomic.CompareAndSwapInt64(&t.tlsMs, -1, time.Since(t.start).Milliseconds())
+			}
+		},
+		GotFirstResponseByte: func() {
+			atomic.CompareAndSwapInt64(&t.ttfbMs, -1, time.Since(t.start).Milliseconds())
+		},
+	})
+}
+
+// snapshot turns the running counters into the AttemptStats a finished
+// test*Proxy call folds into its Result.
+func (t *connTiming) snapshot() AttemptStats {
+	return AttemptStats{
+		BytesIn:  atomic.LoadUint64(&t.bytesIn),
+		BytesOut: atomic.LoadUint64(&t.bytesOut),
+		TLSMs:    atomic.LoadInt64(&t.tlsMs),
+		TTFBMs:   atomic.LoadInt64(&t.ttfbMs),
+		TotalMs:  time.Since(t.start).Milliseconds(),
+	}
+}
+
+// countingConn wraps a tracker-tracked net.Conn so every byte it moves folds
+// into the attempt's connTiming.
+type countingConn struct {
+	net.Conn
+	timing *connTiming
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.timing.addIn(n)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.timing.addOut(n)
+	}
+	return n, err
+}
+
+// AttemptStats is the bandwidth/latency half of a Result, populated by
+// testHTTPProxy/testHTTPSProxy/testSocks5Proxy. Under -probe-engine=fasthttp
+// these all come back zero/-1: the fasthttp dial funcs don't go through
+// countingConn and httptrace doesn't hook fasthttp's client.
+type AttemptStats struct {
+	BytesIn  uint64
+	BytesOut uint64
+	TLSMs    int64
+	TTFBMs   int64
+	TotalMs  int64
+}
+
+// resultToLineFormatted renders r per format ("legacy"/"json"/"csv"); an
+// unrecognized format falls back to legacy so a typo'd -out-format can't
+// corrupt the output file.
+func resultToLineFormatted(r Result, format string) string {
+	switch format {
+	case outFormatJSON:
+		return resultToJSONLine(r)
+	case outFormatCSV:
+		return resultToCSVLine(r)
+	default:
+		return resultToLine(r)
+	}
+}
+
+type resultJSON struct {
+	Addr     string `json:"addr"`
+	Type     string `json:"type"`
+	ISP      string `json:"isp"`
+	Country  string `json:"country"`
+	TLSMs    int64  `json:"tls_ms"`
+	TTFBMs   int64  `json:"ttfb_ms"`
+	TotalMs  int64  `json:"total_ms"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+	Status   int    `json:"status"`
+
+	// TLS fingerprint; empty/false unless ProxyType is HTTPS (see TLSFingerprint).
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipher      string `json:"tls_cipher,omitempty"`
+	ALPN           string `json:"alpn,omitempty"`
+	CertCN         string `json:"cert_cn,omitempty"`
+	CertIssuer     string `json:"cert_issuer,omitempty"`
+	CertSelfSigned bool   `json:"cert_self_signed,omitempty"`
+}
+
+func resultToJSONLine(r Result) string {
+	buf, err := json.Marshal(resultJSON{
+		Addr:           r.ProxyAddr,
+		Type:           strings.ToLower(r.ProxyType),
+		ISP:            r.ISP,
+		Country:        r.Country,
+		TLSMs:          r.TLSMs,
+		TTFBMs:         r.TTFBMs,
+		TotalMs:        r.TotalMs,
+		BytesIn:        r.BytesIn,
+		BytesOut:       r.BytesOut,
+		Status:         r.StatusCode,
+		TLSVersion:     r.TLSVersion,
+		TLSCipher:      r.TLSCipher,
+		ALPN:           r.ALPN,
+		CertCN:         r.CertCN,
+		CertIssuer:     r.CertIssuer,
+		CertSelfSigned: r.CertSelfSigned,
+	})
+	if err != nil {
+		return resultToLine(r)
+	}
+	return string(buf) + "\n"
+}
+
+func resultToCSVLine(r Result) string {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	_ = w.Write([]string{
+		r.ProxyAddr,
+		strings.ToLower(r.ProxyType),
+		r.ISP,
+		r.Country,
+		fmt.Sprintf("%d", r.TLSMs),
+		fmt.Sprintf("%d", r.TTFBMs),
+		fmt.Sprintf("%d", r.TotalMs),
+		fmt.Sprintf("%d", r.BytesIn),
+		fmt.Sprintf("%d", r.BytesOut),
+		fmt.Sprintf("%d", r.StatusCode),
+		r.TLSVersion,
+		r.TLSCipher,
+		r.ALPN,
+		r.CertCN,
+		r.CertIssuer,
+		fmt.Sprintf("%v", r.CertSelfSigned),
+	})
+	w.Flush()
+	return buf.String()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// acmeTLSALPNMagic is the special -test-targets URL value that swaps in the
+// locally-spun ALPN origin from acmeorigin.go instead of an external URL.
+const acmeTLSALPNMagic = "acme-tls-alpn"
+
+// TestTarget is one entry in the -test-targets reachability matrix: an
+// endpoint fetched through the proxy (in addition to the ipinfo lookup) to
+// confirm what the proxy can actually reach — useful when proxies are
+// chained behind a corporate PAC that only allow-lists certain
+// destinations. URL may be acmeTLSALPNMagic to exercise the built-in
+// self-signed ALPN h2 origin instead of a real URL.
+type TestTarget struct {
+	Name         string // for reporting; defaults to URL
+	URL          string
+	ExpectStatus int     // 0 = any 2xx
+	ExpectSubstr string  // "" = don't check body
+	Weight       float64 // 0 becomes 1 in parseTestTargets
+}
+
+// TargetResult is one target's outcome within a single proxy's test run.
+type TargetResult struct {
+	Name    string
+	Success bool
+	Err     string
+}
+
+// parseTestTargets parses the -test-targets flag: semicolon-separated
+// entries of "name=url[,status[,substring[,weight]]]". name defaults to
+// url when no "name=" prefix is given.
+func parseTestTargets(spec string) ([]TestTarget, error) {
+	var targets []TestTarget
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		fields := strings.Split(part, ",")
+
+		name, url := fields[0], fields[0]
+		if eq := strings.Index(fields[0], "="); eq >= 0 {
+			name, url = fields[0][:eq], fields[0][eq+1:]
+		}
+		if url == "" {
+			return nil, fmt.Errorf("test target missing url: %q", part)
+		}
+
+		t := TestTarget{Name: name, URL: url, Weight: 1}
+		if len(fields) > 1 && strings.TrimSpace(fields[1]) != "" {
+			st, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return nil, fmt.Errorf("test target %q: bad expect-status: %v", name, err)
+			}
+			t.ExpectStatus = st
+		}
+		if len(fields) > 2 {
+			t.ExpectSubstr = strings.TrimSpace(fields[2])
+		}
+		if len(fields) > 3 && strings.TrimSpace(fields[3]) != "" {
+			w, err := strconv.ParseFloat(strings.TrimSpace(fields[3]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("test target %q: bad weight: %v", name, err)
+			}
+			t.Weight = w
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// checkTestTargets runs every target through the proxy under test and
+// returns one TargetResult per target, in order. client is already wired to
+// dial through that proxy for ordinary targets; dial/timeout build a
+// separate HTTP/2-enabled client on demand for acmeTLSALPNMagic, since the
+// shared client intentionally disables HTTP/2 (see test*Proxy transports).
+func checkTestTargets(ctx context.Context, client *http.Client,
+	dial func(ctx context.Context, network, addr string) (net.Conn, error), timeout time.Duration,
+	targets []TestTarget) []TargetResult {
+
+	var alpnClient *http.Client
+	results := make([]TargetResult, len(targets))
+
+	for i, t := range targets {
+		results[i] = TargetResult{Name: t.Name}
+
+		useClient := client
+		target := t.URL
+		wantALPNH2 := false
+
+		if t.URL == acmeTLSALPNMagic {
+			addr, err := startACMETLSALPNOrigin()
+			if err != nil {
+				results[i].Err = fmt.Sprintf("acme-tls-alpn origin: %v", err)
+				continue
+			}
+			target = "https://" + addr + "/"
+			wantALPNH2 = true
+			if alpnClient == nil {
+				alpnClient = &http.Client{
+					Timeout: timeout,
+					Transport: &http.Transport{
+						DialContext:       dial,
+						TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", "http/1.1"}},
+						ForceAttemptHTTP2: true,
+					},
+				}
+			}
+			useClient = alpnClient
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		req.Header.Set("User-Agent", userAgent)
+
+		resp, err := useClient.Do(req)
+		if err != nil {
+			results[i].Err = err.Error()
+			continue
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+
+		switch {
+		case t.ExpectStatus != 0 && resp.StatusCode != t.ExpectStatus:
+			results[i].Err = fmt.Sprintf("status=%d want=%d", resp.StatusCode, t.ExpectStatus)
+		case t.ExpectStatus == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 300):
+			results[i].Err = fmt.Sprintf("status=%d", resp.StatusCode)
+		case t.ExpectSubstr != "" && !strings.Contains(string(body), t.ExpectSubstr):
+			results[i].Err = fmt.Sprintf("body missing %q", t.ExpectSubstr)
+		case wantALPNH2 && resp.ProtoMajor != 2:
+			results[i].Err = fmt.Sprintf("alpn did not negotiate h2 (got HTTP/%d.%d)", resp.ProtoMajor, resp.ProtoMinor)
+		default:
+			results[i].Success = true
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned by testOne when the host's circuit breaker is
+// open; classifyErr recognizes it so it flows through the normal
+// failReasons/choosePrimaryReason pipeline as "breaker_open".
+var errBreakerOpen = errors.New("circuit breaker open for this host")
+
+// breakerState is a classic three-state circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// qualifyingFailClasses are the classifyErr results that count as evidence
+// the host itself (not just this particular proxy/auth combo) is dead —
+// the same classes the worker's ipUnreachable heuristic already reacts to.
+var qualifyingFailClasses = map[string]bool{
+	"refused":     true,
+	"unreachable": true,
+	"reset":       true,
+	"timeout":     true,
+}
+
+// hostBreaker tracks one host's (proxy IP's) recent failure streak.
+type hostBreaker struct {
+	mu               sync.Mutex
+	state            breakerState
+	consecutiveFails int
+	windowStart      time.Time
+	openedAt         time.Time
+	halfOpenProbing  bool
+}
+
+// BreakerRegistry is a per-host (proxy IP) circuit breaker registry: after
+// failThreshold consecutive qualifying failures within window, a host's
+// breaker trips open for cooldown, then allows a single half-open probe
+// before closing again on success (or re-opening on failure).
+type BreakerRegistry struct {
+	mu            sync.Mutex
+	hosts         map[string]*hostBreaker
+	failThreshold int
+	window        time.Duration
+	cooldown      time.Duration
+}
+
+// newBreakerRegistry builds a registry. failThreshold<=0 disables tripping
+// entirely (Allow always returns true).
+func newBreakerRegistry(failThreshold int, window, cooldown time.Duration) *BreakerRegistry {
+	return &BreakerRegistry{
+		hosts:         make(map[string]*hostBreaker),
+		failThreshold: failThreshold,
+		window:        window,
+		cooldown:      cooldown,
+	}
+}
+
+func (r *BreakerRegistry) get(host string) *hostBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.hosts[host]
+	if !ok {
+		b = &hostBreaker{}
+		r.hosts[host] = b
+	}
+	return b
+}
+
+// Allow reports whether a probe to host may proceed. When the breaker is
+// open but cooldown has elapsed, it transitions to half-open and allows
+// exactly one caller through as the probe.
+func (r *BreakerRegistry) Allow(host string) bool {
+	if r == nil || r.failThreshold <= 0 {
+		return true
+	}
+	b := r.get(host)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if b.halfOpenProbing {
+			return false
+		}
+		b.halfOpenProbing = true
+		return true
+	case breakerOpen:
+		if time.Since(b.openedAt) < r.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.halfOpenProbing = true
+		return true
+	}
+	return true
+}
+
+// RecordResult feeds a single attempt's outcome back into host's breaker.
+// errClass is the classifyErr result on failure ("" on success).
+func (r *BreakerRegistry) RecordResult(host string, success bool, errClass string) {
+	if r == nil || r.failThreshold <= 0 {
+		return
+	}
+	b := r.get(host)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = breakerClosed
+		b.consecutiveFails = 0
+		b.halfOpenProbing = false
+		return
+	}
+
+	if b.state == breakerHalfOpen {
+		// 半开探测仍然失败，直接重新回到 open 并重置冷却计时
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.halfOpenProbing = false
+		return
+	}
+
+	if !qualifyingFailClasses[errClass] {
+		return
+	}
+
+	now := time.Now()
+	if b.windowStart.IsZero() || now.Sub(b.windowStart) > r.window {
+		b.windowStart = now
+		b.consecutiveFails = 0
+	}
+	b.consecutiveFails++
+
+	if b.consecutiveFails >= r.failThreshold {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
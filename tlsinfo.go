@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+)
+
+// TLSPolicy is the -tls-min/-require-alpn filter applied in testHTTPSProxy:
+// MinVersion rejects handshakes below it, RequireALPN (when non-empty)
+// rejects ones whose negotiated protocol isn't in the list.
+type TLSPolicy struct {
+	MinVersion  uint16
+	RequireALPN []string
+}
+
+// parseTLSVersion turns a -tls-min value ("1.0".."1.3") into a tls.VersionTLSxx
+// constant.
+func parseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimSpace(s) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q, want one of 1.0/1.1/1.2/1.3", s)
+	}
+}
+
+// tlsVersionName renders a tls.VersionTLSxx constant the same way -tls-min
+// accepts it, so Result.TLSVersion round-trips through the flag's own format.
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+// parseALPNAllowlist parses the comma-separated -require-alpn value; an
+// empty spec means "no filter".
+func parseALPNAllowlist(spec string) []string {
+	var out []string
+	for _, p := range strings.Split(spec, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// alpnAllowed reports whether proto passes allowlist (always true when the
+// allowlist is empty, i.e. -require-alpn wasn't set).
+func alpnAllowed(proto string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	for _, want := range allowlist {
+		if proto == want {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsCapture latches the ConnectionState of the first successful TLS
+// handshake to the ipinfo target seen through an httptrace-instrumented
+// context, so testHTTPSProxy can tell a real HTTPS exit (valid/expected
+// cert chain, negotiated ALPN) from an opportunistic MITM proxy.
+type tlsCapture struct {
+	mu         sync.Mutex
+	captured   bool
+	version    string
+	cipher     string
+	alpn       string
+	certCN     string
+	certIssuer string
+	selfSigned bool
+}
+
+func newTLSCapture() *tlsCapture { return &tlsCapture{} }
+
+func (c *tlsCapture) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.captured {
+				return
+			}
+			c.captured = true
+			c.version = tlsVersionName(state.Version)
+			c.cipher = tls.CipherSuiteName(state.CipherSuite)
+			c.alpn = state.NegotiatedProtocol
+			if len(state.PeerCertificates) > 0 {
+				leaf := state.PeerCertificates[0]
+				c.certCN = leaf.Subject.CommonName
+				c.certIssuer = leaf.Issuer.CommonName
+				c.selfSigned = bytes.Equal(leaf.RawIssuer, leaf.RawSubject)
+			}
+		},
+	})
+}
+
+// TLSFingerprint is the TLS-fingerprint half of a Result, populated by
+// testHTTPSProxy. Zero values (empty strings, CertSelfSigned=false) mean no
+// handshake was observed to the ipinfo target — e.g. the attempt failed
+// before TLS, or -probe-engine=fasthttp (httptrace doesn't hook fasthttp).
+type TLSFingerprint struct {
+	Version    string
+	Cipher     string
+	ALPN       string
+	CertCN     string
+	CertIssuer string
+	SelfSigned bool
+}
+
+// fingerprint reads back the captured fields as a TLSFingerprint.
+func (c *tlsCapture) fingerprint() TLSFingerprint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return TLSFingerprint{
+		Version:    c.version,
+		Cipher:     c.cipher,
+		ALPN:       c.alpn,
+		CertCN:     c.certCN,
+		CertIssuer: c.certIssuer,
+		SelfSigned: c.selfSigned,
+	}
+}